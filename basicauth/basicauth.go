@@ -0,0 +1,60 @@
+package basicauth
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Config defines the config for the htpasswd backed BasicAuth middleware.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// HtpasswdFile is the path of an Apache htpasswd file.
+	// Required.
+	HtpasswdFile string
+
+	// Realm is sent in the WWW-Authenticate challenge.
+	// default "Restricted"
+	Realm string
+}
+
+// DefaultConfig is the default BasicAuth middleware config
+var DefaultConfig = Config{
+	Skipper: middleware.DefaultSkipper,
+	Realm:   "Restricted",
+}
+
+// Middleware returns a BasicAuth middleware checking credentials against
+// htpasswdFile.
+func Middleware(htpasswdFile string) echo.MiddlewareFunc {
+	c := DefaultConfig
+	c.HtpasswdFile = htpasswdFile
+	return MiddlewareWithConfig(c)
+}
+
+// MiddlewareWithConfig returns a BasicAuth middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+	if config.Realm == "" {
+		config.Realm = DefaultConfig.Realm
+	}
+
+	users, err := LoadHtpasswd(config.HtpasswdFile)
+	if err != nil {
+		panic(err)
+	}
+
+	return middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+		Skipper: config.Skipper,
+		Realm:   config.Realm,
+		Validator: func(user, password string, c echo.Context) (bool, error) {
+			return users.Authenticate(user, password), nil
+		},
+	})
+}
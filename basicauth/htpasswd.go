@@ -0,0 +1,196 @@
+package basicauth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Htpasswd is a set of users loaded from an Apache htpasswd file. Supported
+// hash formats are bcrypt ($2y$, $2a$, $2b$), SHA1 ({SHA}) and Apache MD5
+// ($apr1$). The file is re-read when its modification time changes, so users
+// can be added or removed without restarting moxie.
+type Htpasswd struct {
+	path    string
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+}
+
+// LoadHtpasswd reads the htpasswd file at path.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Authenticate reports whether password matches the stored hash for user.
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	// Keep serving the last good copy if the file is briefly unreadable,
+	// e.g. while an editor replaces it.
+	_ = h.reload()
+
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	return compareHash(hash, password)
+}
+
+func (h *Htpasswd) reload() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	h.mu.RLock()
+	unchanged := h.users != nil && info.ModTime().Equal(h.modTime)
+	h.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return fmt.Errorf("basicauth: %s:%d: malformed entry", h.path, n)
+		}
+		hash := line[i+1:]
+		if !supportedHash(hash) {
+			return fmt.Errorf("basicauth: %s:%d: unsupported hash for user %q", h.path, n, line[:i])
+		}
+		users[line[:i]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.modTime = info.ModTime()
+	h.mu.Unlock()
+	return nil
+}
+
+func supportedHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return true
+	case strings.HasPrefix(hash, "{SHA}"):
+		return true
+	case strings.HasPrefix(hash, "$apr1$"):
+		return true
+	}
+	return false
+}
+
+func compareHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return secureCompare(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(hash[len("$apr1$"):], "$", 2)[0]
+		return secureCompare(hash, apr1(password, salt))
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 implements Apache's variant of the MD5-based crypt(3) algorithm.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+	return out.String()
+}
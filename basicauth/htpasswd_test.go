@@ -0,0 +1,78 @@
+package basicauth
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeHtpasswd(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash := string(hash) // $2a$
+	// Hashes other than bcrypt were made with openssl, not this package.
+	h, err := LoadHtpasswd(writeHtpasswd(t,
+		"# comment",
+		"",
+		"bcrypt2a:"+bcryptHash,
+		"bcrypt2y:$2y$"+bcryptHash[4:],
+		"bcrypt2b:$2b$"+bcryptHash[4:],
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"apr1:$apr1$saltsalt$EGVZDNN6gOqijy.tv9axG/",
+		"apr1short:$apr1$abc$51YrpNiEtKAQp4coykJmu.",
+		"apr1long:$apr1$Zz9./$wkkw8aZrRkEzy5LRN0Lx2/",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		user, password string
+		want           bool
+	}{
+		{"bcrypt2a", "secret", true},
+		{"bcrypt2a", "Secret", false},
+		{"bcrypt2y", "secret", true},
+		{"bcrypt2y", "wrong", false},
+		{"bcrypt2b", "secret", true},
+		{"bcrypt2b", "", false},
+		{"sha", "secret", true},
+		{"sha", "secret ", false},
+		{"apr1", "correct horse", true},
+		{"apr1", "correct horsE", false},
+		{"apr1short", "x", true},
+		{"apr1short", "y", false},
+		{"apr1long", "a password longer than sixteen bytes", true},
+		{"apr1long", "a password longer than sixteen byte", false},
+		{"nobody", "secret", false},
+		{"", "", false},
+	} {
+		if got := h.Authenticate(tc.user, tc.password); got != tc.want {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tc.user, tc.password, got, tc.want)
+		}
+	}
+}
+
+func TestLoadHtpasswdErrors(t *testing.T) {
+	for _, line := range []string{
+		"alice:plaintext",
+		"alice:$1$salt$hash", // crypt MD5, not Apache's
+		":$apr1$abc$51YrpNiEtKAQp4coykJmu.",
+		"alice",
+	} {
+		if _, err := LoadHtpasswd(writeHtpasswd(t, line)); err == nil {
+			t.Errorf("LoadHtpasswd accepted %q", line)
+		}
+	}
+}
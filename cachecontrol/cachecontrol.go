@@ -0,0 +1,190 @@
+package cachecontrol
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config defines the config for CacheControl middleware.
+//
+// The Cache-Control of a response is that of the first rule matching the
+// path of the file served, as a file server stores it in the context, or else
+// the request path, or Default. Error responses get none, so a file requested
+// before it is deployed is not cached as missing, and responses whose handler
+// set a Cache-Control keep it.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// Rules in order, the first one matching a path applies.
+	// Optional.
+	Rules []Rule
+
+	// Default Cache-Control of paths matching no rule.
+	// default "public, max-age=3600"
+	Default string
+
+	// Expires adds an Expires header matching the max-age, for HTTP/1.0
+	// caches.
+	// Optional.
+	Expires bool
+
+	// Disable sends "no-store" on every response instead, whatever the
+	// handler set.
+	// Optional.
+	Disable bool
+
+	// ContextKey is where a file server stores the path of the file it
+	// serves, which differs from the request path for directory indexes
+	// and fallbacks.
+	// default "static_file"
+	ContextKey string
+}
+
+// Rule sets Cache-Control on the paths it matches by Glob, Regex or
+// Extensions. A rule matches when any of them does.
+type Rule struct {
+	// Glob matches the file name, like "*.html", or the whole path when
+	// it has a slash, like "/static/*/*.css". See path.Match.
+	Glob string
+
+	// Regex matches anywhere in the path, like `\.[0-9a-f]{12}\.js$`.
+	Regex string
+
+	// Extensions match the end of the path, like ".woff2".
+	Extensions []string
+
+	// Value of the Cache-Control header.
+	// Required.
+	Value string
+
+	regex *regexp.Regexp
+}
+
+// DefaultConfig is the default CacheControl middleware config
+var DefaultConfig = Config{
+	Skipper:    middleware.DefaultSkipper,
+	Default:    "public, max-age=3600",
+	ContextKey: "static_file",
+}
+
+// Middleware returns a CacheControl middleware applying rules.
+func Middleware(rules []Rule) echo.MiddlewareFunc {
+	c := DefaultConfig
+	c.Rules = rules
+	return MiddlewareWithConfig(c)
+}
+
+// MiddlewareWithConfig returns a CacheControl middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+	if config.Default == "" {
+		config.Default = DefaultConfig.Default
+	}
+	if config.ContextKey == "" {
+		config.ContextKey = DefaultConfig.ContextKey
+	}
+	rules := make([]Rule, len(config.Rules))
+	for i, rule := range config.Rules {
+		if rule.Value == "" {
+			panic("echo: cache control rule requires a value")
+		}
+		if rule.Glob == "" && rule.Regex == "" && len(rule.Extensions) == 0 {
+			panic("echo: cache control rule requires a glob, regex or extensions")
+		}
+		if _, err := path.Match(rule.Glob, ""); err != nil {
+			panic("echo: cache control glob " + rule.Glob + ": " + err.Error())
+		}
+		if rule.Regex != "" {
+			rule.regex = regexp.MustCompile(rule.Regex)
+		}
+		rules[i] = rule
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) {
+				return next(c)
+			}
+			res := c.Response()
+			// The file is known and the status final once the header is
+			// written.
+			res.Before(func() {
+				h := res.Header()
+				if res.Status >= http.StatusBadRequest || h.Get("Cache-Control") != "" && !config.Disable {
+					return
+				}
+				value := config.Default
+				if config.Disable {
+					value = "no-store"
+				} else {
+					p := c.Request().URL.Path
+					if file, ok := c.Get(config.ContextKey).(string); ok {
+						p = file
+					}
+					for _, rule := range rules {
+						if rule.matches(p) {
+							value = rule.Value
+							break
+						}
+					}
+				}
+				h.Set("Cache-Control", value)
+				if config.Expires {
+					h.Set("Expires", expires(value, time.Now()))
+				}
+			})
+			return next(c)
+		}
+	}
+}
+
+func (r *Rule) matches(p string) bool {
+	if r.Glob != "" {
+		name := p
+		if !strings.Contains(r.Glob, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(r.Glob, name); ok {
+			return true
+		}
+	}
+	if r.regex != nil && r.regex.MatchString(p) {
+		return true
+	}
+	for _, ext := range r.Extensions {
+		if strings.HasSuffix(strings.ToLower(p), strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// expires returns the Expires date of a Cache-Control value, in the past for
+// responses not to be reused without revalidation.
+func expires(value string, now time.Time) string {
+	maxAge := 0
+	for _, directive := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return time.Unix(0, 0).UTC().Format(http.TimeFormat)
+		case "max-age":
+			if n, err := strconv.Atoi(strings.Trim(arg, `"`)); err == nil {
+				maxAge = n
+			}
+		}
+	}
+	return now.Add(time.Duration(maxAge) * time.Second).UTC().Format(http.TimeFormat)
+}
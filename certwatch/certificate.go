@@ -0,0 +1,179 @@
+package certwatch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Certificate is a certificate loaded from a cert/key file pair that can be
+// replaced while it is being served. Handshakes read it through
+// GetCertificate, so a new OCSP staple or a renewed certificate only affects
+// handshakes that start after the swap.
+type Certificate struct {
+	CertFile string
+	KeyFile  string
+
+	current  atomic.Value // *tls.Certificate
+	reloaded chan struct{}
+	removed  chan struct{}
+
+	mu    sync.Mutex
+	hosts []string
+	state monitorState
+}
+
+// Load reads a certificate and key pair.
+func Load(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{CertFile: certFile, KeyFile: keyFile, reloaded: make(chan struct{}, 1), removed: make(chan struct{})}
+	cert, err := loadPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.current.Store(cert)
+	return c, nil
+}
+
+func loadPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// Reload re-reads the certificate and key files and swaps them in. The
+// files must hold a matching pair whose certificate is currently valid,
+// otherwise an error is returned and the current certificate is kept.
+// Handshakes already under way finish with the certificate they started
+// with.
+func (c *Certificate) Reload() error {
+	cert, err := loadPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	if err := validate(cert.Leaf); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.current.Store(cert)
+	c.mu.Unlock()
+	select {
+	case c.reloaded <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// validate refuses a certificate that is not valid yet or anymore.
+func validate(leaf *x509.Certificate) error {
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Current returns the certificate being served.
+func (c *Certificate) Current() *tls.Certificate {
+	return c.current.Load().(*tls.Certificate)
+}
+
+// Leaf returns the parsed leaf of the certificate being served.
+func (c *Certificate) Leaf() *x509.Certificate {
+	return c.Current().Leaf
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Current(), nil
+}
+
+// AddHost records a host served with this certificate, for status reports.
+func (c *Certificate) AddHost(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range c.hosts {
+		if h == host {
+			return
+		}
+	}
+	c.hosts = append(c.hosts, host)
+}
+
+// RemoveHost forgets a host no longer served with this certificate.
+func (c *Certificate) RemoveHost(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, h := range c.hosts {
+		if h == host {
+			c.hosts = append(c.hosts[:i:i], c.hosts[i+1:]...)
+			return
+		}
+	}
+}
+
+// Hosts returns the hosts served with this certificate.
+func (c *Certificate) Hosts() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.hosts...)
+}
+
+// staple swaps in a copy of the current certificate carrying response, as
+// long as the certificate has not been replaced in the meantime.
+func (c *Certificate) staple(leaf *x509.Certificate, response []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cur := c.Current()
+	if cur.Leaf != leaf {
+		return
+	}
+	stapled := *cur
+	stapled.OCSPStaple = response
+	c.current.Store(&stapled)
+}
+
+// Status describes a certificate for the status endpoint.
+type Status struct {
+	CertFile       string     `json:"cert_file"`
+	Hosts          []string   `json:"hosts"`
+	Subject        string     `json:"subject"`
+	DNSNames       []string   `json:"dns_names"`
+	NotAfter       time.Time  `json:"not_after"`
+	ExpiresInDays  float64    `json:"expires_in_days"`
+	OCSPStatus     string     `json:"ocsp_status"`
+	OCSPNextUpdate *time.Time `json:"ocsp_next_update,omitempty"`
+}
+
+// Status reports the certificate's expiry and OCSP state.
+func (c *Certificate) Status() Status {
+	leaf := c.Leaf()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := Status{
+		CertFile:      c.CertFile,
+		Hosts:         append([]string{}, c.hosts...),
+		Subject:       leaf.Subject.String(),
+		DNSNames:      leaf.DNSNames,
+		NotAfter:      leaf.NotAfter,
+		ExpiresInDays: float64(int(time.Until(leaf.NotAfter).Hours()/24*10)) / 10,
+		OCSPStatus:    c.state.status,
+	}
+	if !c.state.nextUpdate.IsZero() {
+		nextUpdate := c.state.nextUpdate
+		status.OCSPNextUpdate = &nextUpdate
+	}
+	return status
+}
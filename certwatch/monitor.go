@@ -0,0 +1,332 @@
+package certwatch
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/allnash/moxie/metrics"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	expiryGauge = metrics.NewGauge("moxie_tls_certificate_expiry_timestamp_seconds",
+		"Unix time at which the certificate expires.", "cert", "subject")
+	stapledGauge = metrics.NewGauge("moxie_tls_ocsp_stapled",
+		"Whether a good OCSP response is stapled to the certificate.", "cert")
+	ocspNextUpdateGauge = metrics.NewGauge("moxie_tls_ocsp_next_update_timestamp_seconds",
+		"Unix time of the stapled OCSP response's next update.", "cert")
+)
+
+// Logger is the subset of echo.Logger the monitor reports to.
+type Logger interface {
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Monitor staples OCSP responses to its certificates, refreshing them before
+// they expire, and warns as each certificate's expiry crosses one of
+// ExpiryWarningDays.
+type Monitor struct {
+	// Certificates to monitor, use Add after Start.
+	Certificates []*Certificate
+
+	// ExpiryWarningDays are the thresholds, in days before expiry, at which
+	// a warning is logged once.
+	// default 30, 7 and 1 days
+	ExpiryWarningDays []int
+
+	// CheckInterval is how often expiry is checked.
+	// default 1 hour
+	CheckInterval time.Duration
+
+	// Logger receives warnings and errors.
+	// Required.
+	Logger Logger
+
+	// DisableStapling turns off OCSP fetching, only expiry is monitored.
+	DisableStapling bool
+
+	// Client is used for OCSP requests.
+	// default a client with a 10 second timeout
+	Client *http.Client
+
+	mu sync.Mutex
+}
+
+// DefaultExpiryWarningDays are used when Monitor.ExpiryWarningDays is empty.
+var DefaultExpiryWarningDays = []int{30, 7, 1}
+
+// monitorState tracks a certificate's OCSP response and expiry warnings.
+type monitorState struct {
+	status     string
+	nextUpdate time.Time
+	warnedDays int
+	warnedLeaf *x509.Certificate
+}
+
+const (
+	ocspRetryInterval = 5 * time.Minute
+	ocspMinInterval   = time.Minute
+	ocspMaxInterval   = 24 * time.Hour
+	ocspMaxResponse   = 1 << 20
+)
+
+// Start begins stapling and expiry checks in the background.
+func (m *Monitor) Start() {
+	if len(m.ExpiryWarningDays) == 0 {
+		m.ExpiryWarningDays = DefaultExpiryWarningDays
+	}
+	if m.CheckInterval == 0 {
+		m.CheckInterval = time.Hour
+	}
+	if m.Client == nil {
+		m.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	m.mu.Lock()
+	certificates := append([]*Certificate(nil), m.Certificates...)
+	m.mu.Unlock()
+	if !m.DisableStapling {
+		for _, c := range certificates {
+			go m.staple(c)
+		}
+	}
+	go func() {
+		for {
+			for _, c := range m.certificates() {
+				m.CheckExpiry(c)
+			}
+			time.Sleep(m.CheckInterval)
+		}
+	}()
+}
+
+// Add starts monitoring a certificate loaded after Start.
+func (m *Monitor) Add(c *Certificate) {
+	m.mu.Lock()
+	m.Certificates = append(m.Certificates, c)
+	m.mu.Unlock()
+	if !m.DisableStapling {
+		go m.staple(c)
+	}
+	m.CheckExpiry(c)
+}
+
+// Remove stops monitoring a certificate that is no longer served and drops
+// its metrics.
+func (m *Monitor) Remove(c *Certificate) {
+	m.mu.Lock()
+	for i, cert := range m.Certificates {
+		if cert == c {
+			m.Certificates = append(m.Certificates[:i:i], m.Certificates[i+1:]...)
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.removed:
+		return
+	default:
+	}
+	close(c.removed)
+	if leaf := c.state.warnedLeaf; leaf != nil {
+		expiryGauge.Delete(c.CertFile, leaf.Subject.String())
+	}
+	stapledGauge.Delete(c.CertFile)
+	ocspNextUpdateGauge.Delete(c.CertFile)
+}
+
+func (m *Monitor) certificates() []*Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Certificate(nil), m.Certificates...)
+}
+
+// Status reports every certificate, soonest expiry first.
+func (m *Monitor) Status() []Status {
+	certificates := m.certificates()
+	statuses := make([]Status, 0, len(certificates))
+	for _, c := range certificates {
+		statuses = append(statuses, c.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].NotAfter.Before(statuses[j].NotAfter) })
+	return statuses
+}
+
+// CheckExpiry updates c's expiry metric and logs a warning when c crossed
+// another of ExpiryWarningDays. It runs every CheckInterval and should be
+// called after c is reloaded.
+func (m *Monitor) CheckExpiry(c *Certificate) {
+	leaf := c.Leaf()
+	left := time.Until(leaf.NotAfter)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.removed:
+		return
+	default:
+	}
+	if c.state.warnedLeaf != leaf {
+		if old := c.state.warnedLeaf; old != nil && old.Subject.String() != leaf.Subject.String() {
+			expiryGauge.Delete(c.CertFile, old.Subject.String())
+		}
+		c.state.warnedLeaf = leaf
+		c.state.warnedDays = -1
+	}
+	expiryGauge.Set(float64(leaf.NotAfter.Unix()), c.CertFile, leaf.Subject.String())
+	if left <= 0 {
+		if c.state.warnedDays != 0 {
+			m.Logger.Errorf("certificate %s (%s) expired on %s", c.CertFile, leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+			c.state.warnedDays = 0
+		}
+		return
+	}
+	// Warn once for the smallest threshold crossed so far.
+	crossed := -1
+	for _, days := range m.ExpiryWarningDays {
+		if left <= time.Duration(days)*24*time.Hour && (crossed < 0 || days < crossed) {
+			crossed = days
+		}
+	}
+	if crossed >= 0 && (c.state.warnedDays < 0 || crossed < c.state.warnedDays) {
+		m.Logger.Warnf("certificate %s (%s) expires in %.1f days on %s", c.CertFile, leaf.Subject,
+			left.Hours()/24, leaf.NotAfter.Format(time.RFC3339))
+		c.state.warnedDays = crossed
+	}
+}
+
+// staple keeps an OCSP response stapled to c until c is removed, starting
+// over whenever c is reloaded.
+func (m *Monitor) staple(c *Certificate) {
+	for {
+		wait, err := m.refreshOCSP(c)
+		if err != nil {
+			m.Logger.Warnf("OCSP for %s: %v", c.CertFile, err)
+		}
+		var after <-chan time.Time
+		if wait > 0 {
+			after = time.After(wait)
+		}
+		select {
+		case <-after:
+		case <-c.reloaded:
+		case <-c.removed:
+			return
+		}
+	}
+}
+
+// refreshOCSP fetches a fresh OCSP response for c and staples it when the
+// certificate is good. It returns how long to wait before the next refresh,
+// zero meaning the certificate cannot be stapled.
+func (m *Monitor) refreshOCSP(c *Certificate) (time.Duration, error) {
+	cur := c.Current()
+	leaf := cur.Leaf
+	if len(leaf.OCSPServer) == 0 {
+		m.setOCSP(c, "unsupported", time.Time{})
+		return 0, nil
+	}
+	if len(cur.Certificate) < 2 {
+		m.setOCSP(c, "no issuer", time.Time{})
+		return 0, errors.New("certificate file has no issuer certificate to build an OCSP request")
+	}
+	issuer, err := x509.ParseCertificate(cur.Certificate[1])
+	if err != nil {
+		return 0, err
+	}
+
+	raw, resp, err := m.fetchOCSP(leaf, issuer)
+	if err != nil {
+		// Keep a stapled response until it goes stale.
+		c.mu.Lock()
+		stale := c.state.nextUpdate.IsZero() || time.Now().After(c.state.nextUpdate)
+		c.mu.Unlock()
+		if stale {
+			c.staple(leaf, nil)
+			m.setOCSP(c, "error", time.Time{})
+		}
+		return ocspRetryInterval, err
+	}
+
+	wait := time.Hour
+	if !resp.NextUpdate.IsZero() {
+		wait = time.Until(resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2))
+	}
+	if wait < ocspMinInterval {
+		wait = ocspMinInterval
+	}
+	if wait > ocspMaxInterval {
+		wait = ocspMaxInterval
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		c.staple(leaf, raw)
+		m.setOCSP(c, "good", resp.NextUpdate)
+	case ocsp.Revoked:
+		c.staple(leaf, nil)
+		m.setOCSP(c, "revoked", resp.NextUpdate)
+		m.Logger.Errorf("certificate %s (%s) was revoked on %s", c.CertFile, leaf.Subject, resp.RevokedAt.Format(time.RFC3339))
+	default:
+		c.staple(leaf, nil)
+		m.setOCSP(c, "unknown", resp.NextUpdate)
+	}
+	return wait, nil
+}
+
+func (m *Monitor) fetchOCSP(leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	body, err := ocsp.CreateRequest(leaf, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := m.Client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder %s returned status %d", leaf.OCSPServer[0], res.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(res.Body, ocspMaxResponse))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, resp, nil
+}
+
+func (m *Monitor) setOCSP(c *Certificate, status string, nextUpdate time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.removed:
+		return // its metrics are gone
+	default:
+	}
+	c.state.status = status
+	c.state.nextUpdate = nextUpdate
+	stapled := 0.0
+	if status == "good" {
+		stapled = 1
+	}
+	stapledGauge.Set(stapled, c.CertFile)
+	if nextUpdate.IsZero() {
+		ocspNextUpdateGauge.Delete(c.CertFile)
+	} else {
+		ocspNextUpdateGauge.Set(float64(nextUpdate.Unix()), c.CertFile)
+	}
+}
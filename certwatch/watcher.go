@@ -0,0 +1,189 @@
+package certwatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Watcher polls certificate and key files and reloads a Certificate when
+// either of its files changes, e.g. after a renewal by certbot. Symbolic
+// links are followed, so pointing CertFile at certbot's live directory
+// works.
+//
+// When Dir is set, certificate pairs dropped into it as NAME.crt and
+// NAME.key are loaded as well, and are reloaded like the others. They are
+// dropped again when either file is removed.
+type Watcher struct {
+	// Certificates to watch.
+	Certificates []*Certificate
+
+	// Dir is scanned for additional NAME.crt and NAME.key pairs.
+	// Optional.
+	Dir string
+
+	// Interval is how often the files are checked.
+	// default 10 seconds
+	Interval time.Duration
+
+	// Logger receives reload errors.
+	// Required.
+	Logger Logger
+
+	// OnChange is called after a certificate is reloaded or, with added set,
+	// after a new pair in Dir is loaded.
+	// Optional.
+	OnChange func(c *Certificate, added bool)
+
+	// OnRemove is called after a pair loaded from Dir is removed from it.
+	// Optional.
+	OnRemove func(c *Certificate)
+
+	files     map[*Certificate]*watched
+	fromDir   map[*Certificate]bool
+	dirFailed map[string]string // stamp of dir pairs that failed to load
+}
+
+type watched struct {
+	stamp  string // modification time and size of both files
+	failed string // stamp of the last change that failed to load
+}
+
+// Start loads the pairs found in Dir and then polls in the background.
+func (w *Watcher) Start() {
+	if w.Interval == 0 {
+		w.Interval = 10 * time.Second
+	}
+	w.files = map[*Certificate]*watched{}
+	w.fromDir = map[*Certificate]bool{}
+	w.dirFailed = map[string]string{}
+	for _, c := range w.Certificates {
+		w.files[c] = &watched{stamp: stamp(c.CertFile, c.KeyFile)}
+	}
+	w.scanDir()
+	go func() {
+		for range time.Tick(w.Interval) {
+			w.check()
+		}
+	}()
+}
+
+func (w *Watcher) check() {
+	for _, c := range w.Certificates {
+		state := w.files[c]
+		current := stamp(c.CertFile, c.KeyFile)
+		if current == state.stamp || current == state.failed || current == "" {
+			continue
+		}
+		// A renewal writes the certificate and key one after the other.
+		// A pair that does not match yet is retried on the next change.
+		if err := c.Reload(); err != nil {
+			state.failed = current
+			w.Logger.Errorf("reloading certificate %s: %v, keeping the current certificate", c.CertFile, err)
+			continue
+		}
+		state.stamp = current
+		state.failed = ""
+		w.Logger.Warnf("reloaded certificate %s (%s), expires on %s", c.CertFile, c.Leaf().Subject,
+			c.Leaf().NotAfter.Format(time.RFC3339))
+		if w.OnChange != nil {
+			w.OnChange(c, false)
+		}
+	}
+	// New pairs first, so names moving to a renamed pair are never left
+	// without a certificate.
+	w.scanDir()
+	w.removeDir()
+}
+
+// scanDir loads the pairs in Dir that are not watched yet.
+func (w *Watcher) scanDir() {
+	if w.Dir == "" {
+		return
+	}
+	certFiles, err := filepath.Glob(filepath.Join(w.Dir, "*.crt"))
+	if err != nil {
+		return
+	}
+	sort.Strings(certFiles)
+	known := map[string]bool{}
+	for _, c := range w.Certificates {
+		known[c.CertFile] = true
+	}
+	for _, certFile := range certFiles {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		if known[certFile] {
+			continue
+		}
+		if _, err := os.Stat(keyFile); err != nil {
+			continue
+		}
+		current := stamp(certFile, keyFile)
+		if current == "" || w.dirFailed[certFile] == current {
+			continue
+		}
+		c, err := Load(certFile, keyFile)
+		if err == nil {
+			err = validate(c.Leaf())
+		}
+		if err != nil {
+			w.dirFailed[certFile] = current
+			w.Logger.Errorf("loading certificate %s: %v", certFile, err)
+			continue
+		}
+		delete(w.dirFailed, certFile)
+		w.Certificates = append(w.Certificates, c)
+		w.files[c] = &watched{stamp: current}
+		w.fromDir[c] = true
+		w.Logger.Warnf("loaded certificate %s (%s) for %s", certFile, c.Leaf().Subject,
+			strings.Join(c.Leaf().DNSNames, ", "))
+		if w.OnChange != nil {
+			w.OnChange(c, true)
+		}
+	}
+}
+
+// removeDir drops the pairs loaded from Dir whose certificate or key file
+// is gone. A file that exists but cannot be read is kept, as during a
+// renewal.
+func (w *Watcher) removeDir() {
+	var kept, removed []*Certificate
+	for _, c := range w.Certificates {
+		if w.fromDir[c] && (missing(c.CertFile) || missing(c.KeyFile)) {
+			removed = append(removed, c)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	w.Certificates = kept
+	for _, c := range removed {
+		delete(w.files, c)
+		delete(w.fromDir, c)
+		w.Logger.Warnf("removed certificate %s (%s)", c.CertFile, c.Leaf().Subject)
+		if w.OnRemove != nil {
+			w.OnRemove(c)
+		}
+	}
+}
+
+func missing(file string) bool {
+	_, err := os.Stat(file)
+	return os.IsNotExist(err)
+}
+
+// stamp identifies the current contents of the files, or is empty when one
+// of them cannot be read.
+func stamp(files ...string) string {
+	var b strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintf(&b, "%d/%d ", info.ModTime().UnixNano(), info.Size())
+	}
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package cgienv
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Build returns the CGI/1.1 variables (RFC 3875) describing req, the way
+// nginx's uwsgi_params and fastcgi_params do, for gateway protocols that
+// pass requests as variables rather than as HTTP.
+//
+// Request headers become HTTP_* variables. Headers with an underscore in
+// their name are dropped, as nginx does, because their names would be
+// ambiguous with the hyphenated ones once translated.
+//
+// params are applied last and override or add variables. Their values may
+// reference the built variables, e.g. "/var/www${SCRIPT_NAME}".
+func Build(req *http.Request, params map[string]string) map[string]string {
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "moxie",
+		"SERVER_PROTOCOL":   req.Proto,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"SCRIPT_NAME":       "",
+		"PATH_INFO":         req.URL.Path,
+		"DOCUMENT_URI":      req.URL.Path,
+		"REQUEST_SCHEME":    "http",
+		"CONTENT_TYPE":      req.Header.Get("Content-Type"),
+	}
+	if req.ContentLength > 0 {
+		env["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	} else {
+		env["CONTENT_LENGTH"] = ""
+	}
+	if req.TLS != nil {
+		env["REQUEST_SCHEME"] = "https"
+		env["HTTPS"] = "on"
+	}
+
+	host, port := req.Host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	env["SERVER_NAME"] = host
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, p, err := net.SplitHostPort(addr.String()); err == nil {
+			port = p
+		}
+	}
+	if port == "" {
+		port = "80"
+		if req.TLS != nil {
+			port = "443"
+		}
+	}
+	env["SERVER_PORT"] = port
+	if ip, p, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		env["REMOTE_ADDR"] = ip
+		env["REMOTE_PORT"] = p
+	} else {
+		env["REMOTE_ADDR"] = req.RemoteAddr
+	}
+
+	for name, values := range req.Header {
+		if strings.Contains(name, "_") {
+			continue
+		}
+		key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if key == "HTTP_CONTENT_TYPE" || key == "HTTP_CONTENT_LENGTH" || key == "HTTP_PROXY" {
+			// The first two have their own variables, the last one would
+			// end up as the HTTP_PROXY environment variable (httpoxy).
+			continue
+		}
+		separator := ", "
+		if key == "HTTP_COOKIE" {
+			separator = "; "
+		}
+		env[key] = strings.Join(values, separator)
+	}
+	if req.Host != "" {
+		env["HTTP_HOST"] = req.Host
+	}
+
+	Apply(env, params)
+	return env
+}
+
+// Apply sets params in env, expanding references to env's variables.
+func Apply(env, params map[string]string) {
+	expanded := map[string]string{}
+	for name, value := range params {
+		expanded[name] = os.Expand(value, func(v string) string { return env[v] })
+	}
+	for name, value := range expanded {
+		env[name] = value
+	}
+}
+
+// Body returns the request body and its length. A body of unknown length,
+// e.g. a chunked upload, is buffered because gateways need CONTENT_LENGTH
+// up front, in memory up to maxMemory bytes and in a temporary file beyond.
+// cleanup releases the buffer once the body has been sent.
+func Body(req *http.Request, maxMemory int64) (body io.Reader, length int64, cleanup func(), err error) {
+	noop := func() {}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, 0, noop, nil
+	}
+	if req.ContentLength >= 0 {
+		return req.Body, req.ContentLength, noop, nil
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, maxMemory+1))
+	if err != nil {
+		return nil, 0, noop, err
+	}
+	if int64(len(buf)) <= maxMemory {
+		return bytes.NewReader(buf), int64(len(buf)), noop, nil
+	}
+	f, err := ioutil.TempFile("", "moxie-body-")
+	if err != nil {
+		return nil, 0, noop, err
+	}
+	cleanup = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(buf), req.Body))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, noop, err
+	}
+	return f, n, cleanup, nil
+}
@@ -0,0 +1,117 @@
+package clientcert
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+	"strings"
+)
+
+// Headers set on the request sent upstream. They are always removed from the
+// incoming request first so clients cannot inject them.
+const (
+	HeaderVerify      = "X-Client-Verify" // "SUCCESS" or "NONE"
+	HeaderSubject     = "X-Client-Cert-Subject"
+	HeaderIssuer      = "X-Client-Cert-Issuer"
+	HeaderSAN         = "X-Client-Cert-SAN"
+	HeaderSerial      = "X-Client-Cert-Serial"
+	HeaderFingerprint = "X-Client-Cert-Fingerprint" // hex SHA-256 of the DER certificate
+)
+
+// Config defines the config for ClientCert middleware.
+//
+// The certificate itself is verified during the TLS handshake; the middleware
+// enforces its presence and forwards its details upstream.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// Required rejects requests without a verified client certificate.
+	Required bool
+
+	// ServerName is the host the client certificate was requested for. A
+	// certificate verified during a handshake for another server name is
+	// ignored, and rejected with 421 when Required.
+	ServerName string
+}
+
+// DefaultConfig is the default ClientCert middleware config
+var DefaultConfig = Config{
+	Skipper:  middleware.DefaultSkipper,
+	Required: true,
+}
+
+// Middleware returns a ClientCert middleware requiring a certificate.
+func Middleware() echo.MiddlewareFunc {
+	return MiddlewareWithConfig(DefaultConfig)
+}
+
+// MiddlewareWithConfig returns a ClientCert middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			for _, h := range []string{HeaderVerify, HeaderSubject, HeaderIssuer, HeaderSAN, HeaderSerial, HeaderFingerprint} {
+				req.Header.Del(h)
+			}
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			state := req.TLS
+			misdirected := state != nil && config.ServerName != "" &&
+				!strings.EqualFold(state.ServerName, config.ServerName)
+			if state == nil || misdirected || len(state.VerifiedChains) == 0 {
+				if !config.Required {
+					req.Header.Set(HeaderVerify, "NONE")
+					return next(c)
+				}
+				if misdirected {
+					return echo.NewHTTPError(http.StatusMisdirectedRequest, "TLS server name does not match host")
+				}
+				return echo.NewHTTPError(http.StatusForbidden, "client certificate required")
+			}
+
+			cert := state.VerifiedChains[0][0]
+			fingerprint := sha256.Sum256(cert.Raw)
+			req.Header.Set(HeaderVerify, "SUCCESS")
+			req.Header.Set(HeaderSubject, cert.Subject.String())
+			req.Header.Set(HeaderIssuer, cert.Issuer.String())
+			req.Header.Set(HeaderSerial, cert.SerialNumber.String())
+			req.Header.Set(HeaderFingerprint, hex.EncodeToString(fingerprint[:]))
+			if san := subjectAltNames(cert); san != "" {
+				req.Header.Set(HeaderSAN, san)
+			}
+			return next(c)
+		}
+	}
+}
+
+// subjectAltNames renders the certificate's SANs as a comma separated list
+// of "DNS:", "email:", "URI:" and "IP:" entries.
+func subjectAltNames(cert *x509.Certificate) string {
+	var names []string
+	for _, n := range cert.DNSNames {
+		names = append(names, "DNS:"+n)
+	}
+	for _, n := range cert.EmailAddresses {
+		names = append(names, "email:"+n)
+	}
+	for _, u := range cert.URIs {
+		names = append(names, "URI:"+u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	return strings.Join(names, ",")
+}
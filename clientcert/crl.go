@@ -0,0 +1,202 @@
+package clientcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// CRL holds the serial numbers revoked by one or more certificate revocation
+// lists read from a PEM or DER file. Every list must be signed by one of the
+// client CAs. Serials are not tracked per issuer, so with several client CAs a
+// serial revoked by one of them is refused for all. The file is re-read when
+// it changes so a refreshed CRL is used without a restart.
+//
+// Once the NextUpdate of a list has passed, every client certificate is
+// refused until a newer list is written, as OpenSSL does with an expired
+// CRL. A stale list could be missing recent revocations.
+type CRL struct {
+	path       string
+	cas        []*x509.Certificate
+	mu         sync.RWMutex
+	revoked    map[string]bool
+	nextUpdate time.Time // earliest NextUpdate of the lists, zero if none has one
+	modTime    time.Time
+}
+
+// LoadCRL reads the CRL file at path and checks it against cas.
+func LoadCRL(path string, cas []*x509.Certificate) (*CRL, error) {
+	c := &CRL{path: path, cas: cas}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Revoked reports whether cert appears in the CRL.
+func (c *CRL) Revoked(cert *x509.Certificate) bool {
+	// Keep the last good list if the file is briefly unreadable.
+	_ = c.reload()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.revoked[cert.SerialNumber.String()]
+}
+
+// Expired reports whether the NextUpdate of a list has passed, and when.
+func (c *CRL) Expired() (bool, time.Time) {
+	_ = c.reload()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.nextUpdate.IsZero() && time.Now().After(c.nextUpdate), c.nextUpdate
+}
+
+// VerifyConnection implements tls.Config.VerifyConnection, failing the
+// handshake for a revoked client certificate, or for any while the CRL is
+// expired. Unlike VerifyPeerCertificate it also runs for resumed sessions.
+func (c *CRL) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	if expired, nextUpdate := c.Expired(); expired {
+		return fmt.Errorf("clientcert: CRL %s expired on %s", c.path, nextUpdate.Format(time.RFC3339))
+	}
+	for _, chain := range state.VerifiedChains {
+		if len(chain) > 0 && c.Revoked(chain[0]) {
+			return fmt.Errorf("clientcert: certificate %s is revoked", chain[0].SerialNumber)
+		}
+	}
+	return nil
+}
+
+func (c *CRL) reload() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	unchanged := c.revoked != nil && info.ModTime().Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+
+	revoked := map[string]bool{}
+	var nextUpdate time.Time
+	for _, der := range ders {
+		serials, next, err := c.parse(der)
+		if err != nil {
+			return fmt.Errorf("clientcert: %s: %v", c.path, err)
+		}
+		for _, serial := range serials {
+			revoked[serial] = true
+		}
+		if !next.IsZero() && (nextUpdate.IsZero() || next.Before(nextUpdate)) {
+			nextUpdate = next
+		}
+	}
+
+	c.mu.Lock()
+	c.revoked = revoked
+	c.nextUpdate = nextUpdate
+	c.modTime = info.ModTime()
+	c.mu.Unlock()
+	return nil
+}
+
+// parse returns the revoked serial numbers and the next update of a DER
+// encoded CRL after checking it is signed by one of the CAs.
+func (c *CRL) parse(der []byte) ([]string, time.Time, error) {
+	var serials []string
+	list, err := x509.ParseRevocationList(der)
+	if err != nil {
+		// ParseRevocationList only accepts version 2 CRLs, fall back for
+		// version 1 lists as written by "openssl ca -gencrl" without a
+		// crlnumber file.
+		legacy, legacyErr := x509.ParseCRL(der)
+		if legacyErr != nil {
+			return nil, time.Time{}, err
+		}
+		signed := false
+		for _, ca := range c.cas {
+			if ca.CheckCRLSignature(legacy) == nil {
+				signed = true
+			}
+		}
+		if !signed {
+			return nil, time.Time{}, errors.New("CRL is not signed by a client CA")
+		}
+		for _, entry := range legacy.TBSCertList.RevokedCertificates {
+			serials = append(serials, entry.SerialNumber.String())
+		}
+		return serials, legacy.TBSCertList.NextUpdate, nil
+	}
+
+	signed := false
+	for _, ca := range c.cas {
+		if list.CheckSignatureFrom(ca) == nil {
+			signed = true
+		}
+	}
+	if !signed {
+		return nil, time.Time{}, errors.New("CRL is not signed by a client CA")
+	}
+	for _, entry := range list.RevokedCertificateEntries {
+		serials = append(serials, entry.SerialNumber.String())
+	}
+	return serials, list.NextUpdate, nil
+}
+
+// LoadCAs reads a PEM bundle of CA certificates.
+func LoadCAs(path string) (*x509.CertPool, []*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	var certs []*x509.Certificate
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("clientcert: %s: %v", path, err)
+		}
+		pool.AddCert(cert)
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("clientcert: no certificates in " + path)
+	}
+	return pool, certs, nil
+}
@@ -0,0 +1,129 @@
+package clientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) client(serial int64) *x509.Certificate {
+	return &x509.Certificate{SerialNumber: big.NewInt(serial), Issuer: ca.cert.Subject}
+}
+
+// writeCRL writes a PEM CRL of ca revoking serials, valid until nextUpdate.
+func (ca *testCA) writeCRL(t *testing.T, path string, nextUpdate time.Time, serials ...int64) {
+	var entries []x509.RevocationListEntry
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func verify(crl *CRL, cert *x509.Certificate) error {
+	return crl.VerifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}})
+}
+
+func TestCRLRevoked(t *testing.T) {
+	ca := newCA(t, "partners")
+	path := filepath.Join(t.TempDir(), "partners.crl")
+	ca.writeCRL(t, path, time.Now().Add(time.Hour), 2, 3)
+	crl, err := LoadCRL(path, []*x509.Certificate{ca.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(crl, ca.client(2)); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("revoked certificate got %v", err)
+	}
+	if err := verify(crl, ca.client(4)); err != nil {
+		t.Fatalf("valid certificate got %v", err)
+	}
+	if err := crl.VerifyConnection(tls.ConnectionState{}); err != nil {
+		t.Fatalf("no client certificate got %v", err)
+	}
+
+	// A rewritten CRL is picked up without reloading by hand.
+	ca.writeCRL(t, path, time.Now().Add(time.Hour), 4)
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(crl, ca.client(2)); err != nil {
+		t.Fatalf("certificate no longer listed got %v", err)
+	}
+	if err := verify(crl, ca.client(4)); err == nil {
+		t.Fatal("newly revoked certificate accepted")
+	}
+}
+
+func TestCRLExpired(t *testing.T) {
+	ca := newCA(t, "partners")
+	path := filepath.Join(t.TempDir(), "partners.crl")
+	ca.writeCRL(t, path, time.Now().Add(-time.Second), 2)
+	crl, err := LoadCRL(path, []*x509.Certificate{ca.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(crl, ca.client(4)); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("certificate checked against an expired CRL got %v", err)
+	}
+}
+
+func TestCRLNotSignedByCA(t *testing.T) {
+	ca, other := newCA(t, "partners"), newCA(t, "other")
+	path := filepath.Join(t.TempDir(), "partners.crl")
+	other.writeCRL(t, path, time.Now().Add(time.Hour), 2)
+	if _, err := LoadCRL(path, []*x509.Certificate{ca.cert}); err == nil {
+		t.Fatal("CRL signed by another CA accepted")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/allnash/moxie/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// unixServer binds a Unix socket listener and returns the server for it,
+// serving handler over TLS with tlsConfig when the listener asks for it.
+func unixServer(handler http.Handler, opts config.UnixListener, tlsConfig *tls.Config, h2 config.HTTP2) (*http.Server, net.Listener, error) {
+	if opts.TLS && tlsConfig == nil {
+		return nil, nil, fmt.Errorf("unix listener %s: tls requires ssl_port", opts.Path)
+	}
+	l, err := listenUnix(opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unix listener %s: %v", opts.Path, err)
+	}
+	server := &http.Server{Handler: handler}
+	if !opts.TLS {
+		if h2.H2C {
+			server.Handler = h2c.NewHandler(handler, h2Server(h2))
+		}
+		return server, l, nil
+	}
+	server.TLSConfig = tlsConfig
+	if h2.Disable {
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	} else if err := http2.ConfigureServer(server, h2Server(h2)); err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+	return server, tls.NewListener(l, tlsConfig), nil
+}
+
+// listenUnix binds the socket at opts.Path, replacing a stale socket file
+// left by an earlier run, and applies the configured mode and ownership.
+func listenUnix(opts config.UnixListener) (net.Listener, error) {
+	mode := uint64(0660)
+	if opts.Mode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(opts.Mode, 8, 32); err != nil {
+			return nil, fmt.Errorf("invalid mode '%s'", opts.Mode)
+		}
+	}
+	uid, gid, err := owner(opts.Owner, opts.Group)
+	if err != nil {
+		return nil, err
+	}
+	var peer net.Addr = &net.UnixAddr{Name: opts.Path, Net: "unix"}
+	if opts.PeerAddr != "" {
+		ip := net.ParseIP(opts.PeerAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid peer_addr '%s'", opts.PeerAddr)
+		}
+		peer = &net.TCPAddr{IP: ip}
+	}
+
+	if info, err := os.Lstat(opts.Path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("file exists and is not a socket")
+		}
+		if conn, err := net.DialTimeout("unix", opts.Path, time.Second); err == nil {
+			conn.Close()
+			return nil, errors.New("socket is in use")
+		}
+		if err := os.Remove(opts.Path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(opts.Path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Lchown(opts.Path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return localListener{l, peer}, nil
+}
+
+// owner resolves a user and group, by name or id, -1 leaves them unchanged.
+func owner(userName, groupName string) (int, int, error) {
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, err
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// localListener reports every Unix socket peer as peer, the socket's path
+// unless an IP is configured for address based rules to match them.
+type localListener struct {
+	net.Listener
+	peer net.Addr
+}
+
+func (l localListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return localConn{conn, l.peer}, nil
+}
+
+type localConn struct {
+	net.Conn
+	peer net.Addr
+}
+
+func (c localConn) RemoteAddr() net.Addr {
+	return c.peer
+}
@@ -2,23 +2,49 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"github.com/allnash/moxie/basicauth"
+	"github.com/allnash/moxie/cachecontrol"
+	"github.com/allnash/moxie/certwatch"
+	"github.com/allnash/moxie/clientcert"
+	"github.com/allnash/moxie/compress"
 	"github.com/allnash/moxie/config"
+	"github.com/allnash/moxie/forwardauth"
+	"github.com/allnash/moxie/grpcproxy"
+	"github.com/allnash/moxie/httpsredirect"
 	"github.com/allnash/moxie/ipfilter"
+	"github.com/allnash/moxie/jwtauth"
+	"github.com/allnash/moxie/metrics"
 	"github.com/allnash/moxie/models"
+	"github.com/allnash/moxie/oidc"
+	"github.com/allnash/moxie/proxy"
+	"github.com/allnash/moxie/sni"
+	"github.com/allnash/moxie/static"
+	"github.com/allnash/moxie/stream"
+	"github.com/allnash/moxie/tlspolicy"
 	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 const AppYamlFilename = "/etc/moxie/app.yaml"
 
+// hstsPreloadMinAge is the shortest max-age accepted by the HSTS preload list.
+const hstsPreloadMinAge = 31536000
+
 func load() config.Config {
 	var cfg config.Config
 	// read configuration from the file and environment variables
@@ -36,42 +62,154 @@ func main() {
 	// Load ENV
 	cfg := load()
 
+	// Server
+	e := echo.New()
+	e.Use(middleware.Logger())
+	e.Logger.SetOutput(&lumberjack.Logger{
+		Filename:   cfg.Logfile,
+		MaxSize:    100, // megabytes
+		MaxBackups: 3,
+		MaxAge:     28,   //days
+		Compress:   true, // disabled by default
+	})
+	e.Logger.SetLevel(log.WARN)
+
 	// Hosts
 	for _, service := range cfg.Services {
+		if streamed(service) {
+			continue
+		}
 		// Service Target
 		tenant := echo.New()
+		if service.ForceHTTPS {
+			if cfg.SSLPort == "" {
+				e.Logger.Fatal("service " + service.Name + " sets force_https, which needs ssl_port")
+			}
+			tenant.Use(httpsredirect.MiddlewareWithConfig(httpsredirect.Config{
+				Port:           cfg.SSLPort,
+				TrustedProxies: service.TrustedProxies,
+			}))
+		}
+		if service.HSTSPreload && (service.HSTSMaxAge < hstsPreloadMinAge || service.HSTSExcludeSubdomains) {
+			e.Logger.Warn("service " + service.Name + " sets hsts_preload, which needs hsts_max_age of at least 31536000 and subdomains included")
+		}
+		if service.ClientCA != "" {
+			tenant.Use(clientcert.MiddlewareWithConfig(clientcert.Config{
+				Required:   service.ClientAuth != "verify_if_given",
+				ServerName: sni.Hostname(service.IngressUrl),
+			}))
+		}
+		if service.Type == "grpc" {
+			tenant.Use(grpcproxy.MiddlewareWithConfig(grpcproxy.Config{Web: service.GRPC.Web}))
+		}
+		useAuth(tenant, service)
 		var targets []*middleware.ProxyTarget
 		// Service Config
-		if service.Type == "proxy" {
+		if proxied(service) {
 			// Web endpoint
-			urlS, err := url.Parse(service.EgressUrl)
+			urlS, transport, err := upstreamTarget(service, e.Logger)
 			if err != nil {
 				tenant.Logger.Fatal(err)
 			}
 			targets = append(targets, &middleware.ProxyTarget{
 				URL: urlS,
 			})
-			tenant.Use(middleware.Proxy(middleware.NewRoundRobinBalancer(targets)))
+			if service.UpstreamTLS.InsecureSkipVerify {
+				e.Logger.Warn("upstream TLS certificate verification is disabled for service " + service.Name)
+			}
+			if service.HSTSMaxAge > 0 {
+				tenant.Use(middleware.SecureWithConfig(middleware.SecureConfig{
+					HSTSMaxAge:            service.HSTSMaxAge,
+					HSTSExcludeSubdomains: service.HSTSExcludeSubdomains,
+					HSTSPreloadEnabled:    service.HSTSPreload,
+				}))
+			}
+			// gRPC services with their own upstream
+			for name, egress := range service.GRPC.Routes {
+				route := service
+				route.EgressUrl = egress
+				routeURL, routeTransport, err := upstreamTarget(route, e.Logger)
+				if err != nil {
+					tenant.Logger.Fatal(err)
+				}
+				tenant.Use(proxy.MiddlewareWithConfig(proxy.Config{
+					Skipper:   grpcRouteSkipper(name),
+					Balancer:  middleware.NewRoundRobinBalancer([]*middleware.ProxyTarget{{URL: routeURL}}),
+					Transport: routeTransport,
+					Name:      service.Name,
+				}))
+			}
+			flushIntervals := map[string]time.Duration{}
+			for prefix, ms := range service.FlushIntervalPaths {
+				flushIntervals[prefix] = time.Duration(ms) * time.Millisecond
+			}
+			tenant.Use(proxy.MiddlewareWithConfig(proxy.Config{
+				Balancer:             middleware.NewRoundRobinBalancer(targets),
+				Transport:            transport,
+				FlushInterval:        time.Duration(service.FlushInterval) * time.Millisecond,
+				FlushIntervals:       flushIntervals,
+				Name:                 service.Name,
+				WebSocketIdleTimeout: time.Duration(service.WebSocket.IdleTimeout) * time.Second,
+				WebSocketMaxLifetime: time.Duration(service.WebSocket.MaxLifetime) * time.Second,
+				MaxWebSockets:        service.WebSocket.MaxConnections,
+			}))
 			tenant.GET("/*", func(c echo.Context) error {
 				return c.String(http.StatusOK, "Tenant:"+c.Request().Host)
 			})
 			hosts[service.IngressUrl] = &models.Host{Echo: tenant}
 		} else if service.Type == "static" {
 			// Static endpoint
-			tenant.Use(middleware.GzipWithConfig(middleware.GzipConfig{
-				Level: 5,
+			if !service.Compression.Disable {
+				tenant.Use(compress.MiddlewareWithConfig(compress.Config{
+					Encodings: service.Compression.Encodings,
+					MinLength: service.Compression.MinLength,
+					SkipTypes: service.Compression.SkipTypes,
+				}))
+			}
+			cacheRules := make([]cachecontrol.Rule, 0, len(service.CacheControl.Rules))
+			for _, rule := range service.CacheControl.Rules {
+				cacheRules = append(cacheRules, cachecontrol.Rule{
+					Glob:       rule.Glob,
+					Regex:      rule.Regex,
+					Extensions: rule.Extensions,
+					Value:      rule.Value,
+				})
+			}
+			tenant.Use(cachecontrol.MiddlewareWithConfig(cachecontrol.Config{
+				Rules:   cacheRules,
+				Default: service.CacheControl.Default,
+				Expires: service.CacheControl.Expires,
+				Disable: service.CacheControl.Disable,
 			}))
-			tenant.Use(expiresServerHeader)
 			tenant.Use(middleware.BodyLimit("25M"))
 			tenant.Use(middleware.SecureWithConfig(
 				middleware.SecureConfig{
-					XFrameOptions: service.XFrameOptions,
-					HSTSMaxAge:    service.HSTSMaxAge,
+					XFrameOptions:         service.XFrameOptions,
+					HSTSMaxAge:            service.HSTSMaxAge,
+					HSTSExcludeSubdomains: service.HSTSExcludeSubdomains,
+					HSTSPreloadEnabled:    service.HSTSPreload,
 				}))
-			tenant.Use(middleware.StaticWithConfig(middleware.StaticConfig{
-				Root:   service.EgressUrl,
-				Browse: true,
-				HTML5:  true,
+			var manifest *static.Manifest
+			if service.Manifest.File != "" {
+				file := service.Manifest.File
+				if !filepath.IsAbs(file) {
+					file = filepath.Join(service.EgressUrl, file)
+				}
+				var err error
+				if manifest, err = static.LoadManifest(file); err != nil {
+					e.Logger.Fatal("service " + service.Name + ": " + err.Error())
+				}
+				manifest.Interval = time.Duration(service.Manifest.ReloadInterval) * time.Second
+				manifest.Logger = e.Logger
+				manifest.Start()
+			}
+			tenant.Use(static.MiddlewareWithConfig(static.Config{
+				Root:          service.EgressUrl,
+				Browse:        true,
+				HTML5:         true,
+				Precompressed: service.Compression.Precompressed,
+				Manifest:      manifest,
+				Unhashed:      service.Manifest.Unhashed,
 			}))
 			// Add to Hosts
 			hosts[service.IngressUrl] = &models.Host{Echo: tenant}
@@ -81,24 +219,71 @@ func main() {
 	//---------
 	// ROOT
 	//---------
+	var certs *sni.Map
+	var monitor *certwatch.Monitor
+	if cfg.SSLPort != "" {
+		var certificates []*certwatch.Certificate
+		var err error
+		certs, certificates, err = newSNIMap(cfg)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		monitor = &certwatch.Monitor{
+			Certificates:      certificates,
+			ExpiryWarningDays: cfg.TLS.ExpiryWarningDays,
+			DisableStapling:   cfg.TLS.DisableOCSPStapling,
+			Logger:            e.Logger,
+		}
+		monitor.Start()
+
+		policy, _ := tlsPolicy(cfg.TLS, cfg.HTTP2) // already validated by newSNIMap
+		certDir := cfg.TLS.CertDir
+		if certDir == "" {
+			certDir = DefaultSSLCertDir
+		}
+		fromDir := map[*certwatch.Certificate]bool{}
+		dirCerts := newDirCertificates(certs, policy, cfg.Services)
+		watcher := &certwatch.Watcher{
+			Certificates: certificates,
+			Dir:          certDir,
+			Logger:       e.Logger,
+			OnChange: func(c *certwatch.Certificate, added bool) {
+				if added {
+					fromDir[c] = true
+					monitor.Add(c)
+				} else {
+					monitor.CheckExpiry(c)
+				}
+				// A renewed certificate may cover other names.
+				if fromDir[c] {
+					dirCerts.serve(c)
+				}
+			},
+			OnRemove: func(c *certwatch.Certificate) {
+				delete(fromDir, c)
+				dirCerts.remove(c)
+				monitor.Remove(c)
+			},
+		}
+		watcher.Start()
+	}
+
 	server := echo.New()
 	server.Use(middleware.Recover())
 	server.GET("/status", func(c echo.Context) error {
-		return c.String(http.StatusOK, "{\"success\":\"ok\"}")
+		status := struct {
+			Success      string             `json:"success"`
+			Certificates []certwatch.Status `json:"certificates,omitempty"`
+		}{Success: "ok"}
+		if monitor != nil {
+			status.Certificates = monitor.Status()
+		}
+		return c.JSON(http.StatusOK, status)
 	})
+	server.GET("/metrics", metrics.Handler)
 	hosts[cfg.StatusHost+":"+cfg.ProxyListenPort] = &models.Host{Echo: server}
 
-	// Server
-	e := echo.New()
-	e.Use(middleware.Logger())
-	e.Logger.SetOutput(&lumberjack.Logger{
-		Filename:   cfg.Logfile,
-		MaxSize:    100, // megabytes
-		MaxBackups: 3,
-		MaxAge:     28,   //days
-		Compress:   true, // disabled by default
-	})
-	e.Use(ipfilter.MiddlewareWithConfig(ipfilter.Config{
+	ipFilter := ipfilter.Config{
 		Skipper: middleware.DefaultSkipper,
 		BlackList: []string{
 			"104.244.100.0/24",
@@ -4250,7 +4435,14 @@ func main() {
 			"173.54.93.0/24",
 		},
 		BlockByDefault: false,
-	}))
+	}
+	// Layer 4 services share the IP filter of the HTTP services
+	filter, err := ipfilter.New(ipFilter.WhiteList, ipFilter.BlackList, ipFilter.BlockByDefault)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	ipFilter.Filter = filter
+	e.Use(ipfilter.MiddlewareWithConfig(ipFilter))
 	e.Any("/*", func(c echo.Context) (err error) {
 		req := c.Request()
 		res := c.Response()
@@ -4267,22 +4459,122 @@ func main() {
 	// 4 Terabyte limit
 	e.Use(middleware.BodyLimit("4T"))
 
+	passthrough, err := passthroughRoutes(cfg.Services, filter, e.Logger)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	if len(passthrough) > 0 && certs == nil {
+		e.Logger.Fatal("passthrough services need ssl_port")
+	}
+
 	// Start server with Graceful Shutdown WITH CERT
-	//go func() {
-	//	if err := e.StartTLS(":"+cfg.SSLPort,
-	//		"/etc/moxie/ssl/server.crt",
-	//		"/etc/moxie/ssl/server.key"); err != nil && err != http.ErrServerClosed {
-	//		e.Logger.Fatal("shutting down the server")
-	//	}
-	//}()
+	var h3 *http3.Server
+	var tlsConfig *tls.Config
+	if certs != nil {
+		tlsConfig = certs.TLSConfig()
+		if cfg.TLS.SessionTicketKeyFile != "" {
+			if err := tlspolicy.WatchTicketKeys(tlsConfig, cfg.TLS.SessionTicketKeyFile, time.Minute, e.Logger.Errorf); err != nil {
+				e.Logger.Fatal(err)
+			}
+		}
+		e.TLSServer.Addr = ":" + cfg.SSLPort
+		e.TLSServer.TLSConfig = tlsConfig
+		if cfg.HTTP2.Disable {
+			e.TLSServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		} else if err := http2.ConfigureServer(e.TLSServer, h2Server(cfg.HTTP2)); err != nil {
+			e.Logger.Fatal(err)
+		}
+		// Connections for passthrough hosts are spliced before TLS is terminated
+		if len(passthrough) > 0 {
+			l, err := net.Listen("tcp", e.TLSServer.Addr)
+			if err != nil {
+				e.Logger.Fatal(err)
+			}
+			e.TLSListener = tls.NewListener(stream.Passthrough(l, passthrough), e.TLSServer.TLSConfig)
+		}
+		// HTTP/3 shares the certificates and the routing table of the TLS
+		// listener, the Alt-Svc middleware is added before any server runs
+		if cfg.HTTP3.Enable {
+			h3 = &http3.Server{
+				Addr:      ":" + cfg.SSLPort,
+				Port:      cfg.HTTP3.AltSvcPort,
+				TLSConfig: tlsConfig,
+				Handler:   e,
+			}
+			e.Use(altSvcHeader(h3))
+		}
+		go func() {
+			if err := e.StartServer(e.TLSServer); err != nil && err != http.ErrServerClosed {
+				e.Logger.Fatal("shutting down the server")
+			}
+		}()
+		if h3 != nil {
+			go func() {
+				if err := h3.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					e.Logger.Fatal(err)
+				}
+			}()
+		}
+	}
 
 	// Start server with Graceful Shutdown WITHOUT CERT
 	go func() {
-		if err := e.Start(":9000"); err != nil && err != http.ErrServerClosed {
+		var err error
+		if cfg.HTTP2.H2C {
+			err = e.StartH2CServer(":9000", h2Server(cfg.HTTP2))
+		} else {
+			err = e.Start(":9000")
+		}
+		if err != nil && err != http.ErrServerClosed {
 			e.Logger.Fatal("shutting down the server")
 		}
 	}()
 
+	// Unix socket listeners share the routing table of the TCP listeners
+	var unixServers []*http.Server
+	for _, opts := range cfg.UnixListeners {
+		srv, l, err := unixServer(e, opts, tlsConfig, cfg.HTTP2)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		unixServers = append(unixServers, srv)
+		go func() {
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				e.Logger.Fatal(err)
+			}
+		}()
+	}
+
+	// Layer 4 services listen on their own ports
+	var tcpProxies []*stream.TCPProxy
+	var udpProxies []*stream.UDPProxy
+	for _, service := range cfg.Services {
+		switch service.Type {
+		case "tcp":
+			p, l, err := tcpProxy(service, tlsConfig, filter, e.Logger)
+			if err != nil {
+				e.Logger.Fatal(err)
+			}
+			tcpProxies = append(tcpProxies, p)
+			go func() {
+				if err := p.Serve(l); err != nil {
+					e.Logger.Fatal(err)
+				}
+			}()
+		case "udp":
+			p, conn, err := udpProxy(service, filter, e.Logger)
+			if err != nil {
+				e.Logger.Fatal(err)
+			}
+			udpProxies = append(udpProxies, p)
+			go func() {
+				if err := p.Serve(conn); err != nil {
+					e.Logger.Fatal(err)
+				}
+			}()
+		}
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server with a timeout of 10 seconds.
 	// Use a buffered channel to avoid missing signals as recommended for signal.Notify
 	quit := make(chan os.Signal, 1)
@@ -4290,15 +4582,162 @@ func main() {
 	<-quit
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err := e.Shutdown(ctx); err != nil {
+	if h3 != nil {
+		if err := h3.Shutdown(ctx); err != nil {
+			e.Logger.Error(err)
+		}
+	}
+	for _, srv := range unixServers {
+		if err := srv.Shutdown(ctx); err != nil {
+			e.Logger.Error(err)
+		}
+	}
+	for _, p := range passthrough {
+		tcpProxies = append(tcpProxies, p)
+	}
+	for _, p := range udpProxies {
+		p.Close()
+	}
+	for _, p := range tcpProxies {
+		if err := p.Shutdown(ctx); err != nil {
+			e.Logger.Warn("closed " + p.Name + " connections that did not finish in time")
+		}
+	}
+	err = e.Shutdown(ctx)
+	// Upgraded connections are hijacked and not waited for by Shutdown
+	if err := proxy.Shutdown(ctx); err != nil {
+		e.Logger.Warn("closed websocket connections that did not finish in time")
+	}
+	if err != nil {
 		e.Logger.Fatal(err)
 	}
 }
 
-// ServerHeader middleware adds a `Server` header to the response.
-func expiresServerHeader(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		c.Response().Header().Set("Cache-Control", "public, max-age=3600")
-		return next(c)
+// altSvcHeader middleware advertises the HTTP/3 listener on responses sent
+// over TLS on TCP.
+func altSvcHeader(h3 *http3.Server) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if req := c.Request(); req.TLS != nil && req.ProtoMajor < 3 {
+				_ = h3.SetQUICHeaders(c.Response().Header())
+			}
+			return next(c)
+		}
+	}
+}
+
+// useAuth installs the authentication middleware selected by service.Auth.
+func useAuth(tenant *echo.Echo, service config.Service) {
+	switch service.Auth {
+	case "":
+	case "basic":
+		tenant.Use(basicauth.MiddlewareWithConfig(basicauth.Config{
+			Skipper:      authSkipper(service),
+			HtpasswdFile: service.HtpasswdFile,
+			Realm:        service.AuthRealm,
+		}))
+	case "forward":
+		tenant.Use(forwardauth.MiddlewareWithConfig(forwardauth.Config{
+			Skipper:         authSkipper(service),
+			URL:             service.ForwardAuthURL,
+			ResponseHeaders: service.ForwardAuthHeaders,
+		}))
+	case "jwt":
+		tenant.Use(jwtauth.MiddlewareWithConfig(jwtauth.Config{
+			Skipper:       authSkipper(service),
+			Verifier:      jwtVerifier(service.JWT),
+			ClaimsHeaders: service.JWT.ClaimsHeaders,
+			Realm:         service.AuthRealm,
+		}))
+	case "oidc":
+		tenant.Use(oidc.MiddlewareWithConfig(oidc.Config{
+			Skipper:        authSkipper(service),
+			Issuer:         service.OIDC.Issuer,
+			ClientID:       service.OIDC.ClientID,
+			ClientSecret:   service.OIDC.ClientSecret,
+			RedirectURL:    service.OIDC.RedirectURL,
+			Scopes:         service.OIDC.Scopes,
+			CookieName:     service.OIDC.CookieName,
+			CookieSecret:   service.OIDC.CookieSecret,
+			AllowedDomains: service.OIDC.AllowedDomains,
+			AllowedGroups:  service.OIDC.AllowedGroups,
+			GroupsClaim:    service.OIDC.GroupsClaim,
+			ClaimsHeaders:  service.OIDC.ClaimsHeaders,
+		}))
+	default:
+		tenant.Logger.Fatal("unknown auth '" + service.Auth + "' for service " + service.Name)
+	}
+}
+
+// jwtVerifier builds the token verifier for a service's jwt block.
+func jwtVerifier(cfg config.JWT) *jwtauth.Verifier {
+	var keys *jwtauth.KeySet
+	switch {
+	case cfg.JWKSFile != "":
+		var err error
+		if keys, err = jwtauth.NewFileKeySet(cfg.JWKSFile); err != nil {
+			panic(err)
+		}
+	case cfg.JWKSURL != "":
+		keys = jwtauth.NewRemoteKeySet(cfg.JWKSURL)
+	case cfg.Secret != "":
+		keys = jwtauth.NewStaticKeySet(map[string]interface{}{"": []byte(cfg.Secret)})
+	default:
+		panic("jwt auth requires jwks_url, jwks_file or secret")
+	}
+	return &jwtauth.Verifier{
+		Keys:       keys,
+		Algorithms: cfg.Algorithms,
+		Issuer:     cfg.Issuer,
+		Audience:   cfg.Audience,
+		Leeway:     time.Duration(cfg.Leeway) * time.Second,
+	}
+}
+
+// authSkipper skips authentication for paths outside service.AuthPaths (when
+// set), for service.AuthExemptPaths and for clients connecting from
+// service.AuthExemptIPs. The peer address is used rather than X-Forwarded-For
+// so the exemption cannot be spoofed.
+func authSkipper(service config.Service) middleware.Skipper {
+	exemptIPs, err := ipfilter.New(service.AuthExemptIPs, nil, true)
+	if err != nil {
+		panic(err)
+	}
+	return func(c echo.Context) bool {
+		p := path.Clean("/" + c.Request().URL.Path)
+		if len(service.AuthPaths) > 0 && !hasPathPrefix(p, service.AuthPaths) {
+			return true
+		}
+		if hasPathPrefix(p, service.AuthExemptPaths) {
+			return true
+		}
+		if len(service.AuthExemptIPs) > 0 {
+			ip := c.Request().RemoteAddr
+			if host, _, err := net.SplitHostPort(ip); err == nil {
+				ip = host
+			}
+			return exemptIPs.AllowedString(ip)
+		}
+		return false
+	}
+}
+
+// grpcRouteSkipper skips requests that are not calls of the gRPC service
+// name, e.g. "helloworld.Greeter" for /helloworld.Greeter/SayHello.
+func grpcRouteSkipper(name string) middleware.Skipper {
+	prefix := "/" + strings.Trim(name, "/") + "/"
+	return func(c echo.Context) bool {
+		return !strings.HasPrefix(c.Request().URL.Path, prefix)
+	}
+}
+
+// hasPathPrefix reports whether p equals or is below one of prefixes.
+func hasPathPrefix(p string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/allnash/moxie/config"
+	"github.com/allnash/moxie/ipfilter"
+	"github.com/allnash/moxie/sni"
+	"github.com/allnash/moxie/stream"
+	"net"
+	"time"
+)
+
+// streamed reports whether service is proxied at layer 4 rather than served
+// as a host of the HTTP listeners.
+func streamed(service config.Service) bool {
+	return service.Type == "tcp" || service.Type == "udp" || service.Type == "passthrough"
+}
+
+// tcpProxy returns the proxy and listener of a 'tcp' service. TLS is
+// terminated with tlsConfig, the TLS listener's, when the service asks for
+// it.
+func tcpProxy(service config.Service, tlsConfig *tls.Config, filter *ipfilter.Filter, logger stream.Logger) (*stream.TCPProxy, net.Listener, error) {
+	opts := service.Stream
+	if opts.Listen == "" {
+		return nil, nil, fmt.Errorf("service %s: stream listen is required", service.Name)
+	}
+	pool, err := streamPool(service, opts.Upstreams, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &stream.TCPProxy{
+		Name:        service.Name,
+		Pool:        pool,
+		Filter:      filter,
+		IdleTimeout: time.Duration(opts.IdleTimeout) * time.Second,
+		Logger:      logger,
+	}
+	switch opts.TLS {
+	case "":
+	case "terminate":
+		if tlsConfig == nil {
+			return nil, nil, fmt.Errorf("service %s: tls terminate requires ssl_port", service.Name)
+		}
+		p.TLSConfig = tlsConfig
+	default:
+		return nil, nil, fmt.Errorf("service %s: unknown tls '%s'", service.Name, opts.TLS)
+	}
+	if len(opts.SNIRoutes) > 0 {
+		p.Routes = map[string]*stream.Pool{}
+		for name, upstreams := range opts.SNIRoutes {
+			if p.Routes[name], err = streamPool(service, upstreams, logger); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	l, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		return nil, nil, fmt.Errorf("service %s: %v", service.Name, err)
+	}
+	return p, l, nil
+}
+
+// udpProxy returns the proxy and socket of a 'udp' service.
+func udpProxy(service config.Service, filter *ipfilter.Filter, logger stream.Logger) (*stream.UDPProxy, net.PacketConn, error) {
+	opts := service.Stream
+	if opts.Listen == "" {
+		return nil, nil, fmt.Errorf("service %s: stream listen is required", service.Name)
+	}
+	if opts.TLS != "" || len(opts.SNIRoutes) > 0 {
+		return nil, nil, fmt.Errorf("service %s: tls and sni_routes need a tcp service", service.Name)
+	}
+	if opts.HealthCheckInterval == 0 {
+		// Health checks connect over TCP, UDP upstreams are marked down
+		// by ICMP port unreachable and up by their replies instead.
+		service.Stream.HealthCheckInterval = -1
+	}
+	pool, err := streamPool(service, opts.Upstreams, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.ListenPacket("udp", opts.Listen)
+	if err != nil {
+		return nil, nil, fmt.Errorf("service %s: %v", service.Name, err)
+	}
+	return &stream.UDPProxy{
+		Name:        service.Name,
+		Pool:        pool,
+		Filter:      filter,
+		IdleTimeout: time.Duration(opts.IdleTimeout) * time.Second,
+		MaxSessions: opts.MaxSessions,
+		Logger:      logger,
+	}, conn, nil
+}
+
+// passthroughRoutes returns the proxies of the 'passthrough' services by
+// the server name they take from the TLS listener.
+func passthroughRoutes(services []config.Service, filter *ipfilter.Filter, logger stream.Logger) (map[string]*stream.TCPProxy, error) {
+	routes := map[string]*stream.TCPProxy{}
+	for _, service := range services {
+		if service.Type != "passthrough" {
+			continue
+		}
+		opts := service.Stream
+		if opts.Listen != "" || opts.TLS != "" || len(opts.SNIRoutes) > 0 {
+			return nil, fmt.Errorf("service %s: passthrough shares ssl_port, listen, tls and sni_routes need a tcp service", service.Name)
+		}
+		name := sni.Hostname(service.IngressUrl)
+		if name == "" {
+			return nil, fmt.Errorf("service %s: passthrough needs an ingress_url", service.Name)
+		}
+		if _, ok := routes[name]; ok {
+			return nil, fmt.Errorf("service %s: %s is passed through by another service", service.Name, name)
+		}
+		pool, err := streamPool(service, opts.Upstreams, logger)
+		if err != nil {
+			return nil, err
+		}
+		routes[name] = &stream.TCPProxy{
+			Name:        service.Name,
+			Pool:        pool,
+			Filter:      filter,
+			IdleTimeout: time.Duration(opts.IdleTimeout) * time.Second,
+			Logger:      logger,
+		}
+	}
+	return routes, nil
+}
+
+// streamPool returns a started pool of upstreams, egress_url when none are
+// given.
+func streamPool(service config.Service, upstreams []string, logger stream.Logger) (*stream.Pool, error) {
+	if len(upstreams) == 0 && service.EgressUrl != "" {
+		upstreams = []string{service.EgressUrl}
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("service %s: no upstreams", service.Name)
+	}
+	for _, addr := range upstreams {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("service %s: upstream %s: %v", service.Name, addr, err)
+		}
+	}
+	pool := &stream.Pool{
+		Addresses: upstreams,
+		Name:      service.Name,
+		Interval:  time.Duration(service.Stream.HealthCheckInterval) * time.Second,
+		Logger:    logger,
+	}
+	pool.Start()
+	return pool, nil
+}
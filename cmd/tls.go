@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/allnash/moxie/certwatch"
+	"github.com/allnash/moxie/clientcert"
+	"github.com/allnash/moxie/config"
+	"github.com/allnash/moxie/sni"
+	"github.com/allnash/moxie/tlspolicy"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	DefaultSSLCertFile = "/etc/moxie/ssl/server.crt"
+	DefaultSSLKeyFile  = "/etc/moxie/ssl/server.key"
+	DefaultSSLCertDir  = "/etc/moxie/ssl"
+)
+
+// newSNIMap loads the default certificate and the certificate and client
+// authentication settings of every service into an SNI map, applying the
+// TLS policy to each entry. It also returns every distinct certificate
+// loaded, for stapling and expiry monitoring.
+func newSNIMap(cfg config.Config) (*sni.Map, []*certwatch.Certificate, error) {
+	policy, err := tlsPolicy(cfg.TLS, cfg.HTTP2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certFile, keyFile := cfg.SSLCertFile, cfg.SSLKeyFile
+	if certFile == "" {
+		certFile = DefaultSSLCertFile
+	}
+	if keyFile == "" {
+		keyFile = DefaultSSLKeyFile
+	}
+
+	loaded := map[string]*certwatch.Certificate{}
+	var all []*certwatch.Certificate
+	load := func(certFile, keyFile string) (*certwatch.Certificate, error) {
+		if cert, ok := loaded[certFile+"\x00"+keyFile]; ok {
+			return cert, nil
+		}
+		cert, err := certwatch.Load(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		loaded[certFile+"\x00"+keyFile] = cert
+		all = append(all, cert)
+		return cert, nil
+	}
+
+	def, err := load(certFile, keyFile)
+	if err != nil {
+		if cfg.SSLCertFile != "" || !os.IsNotExist(err) {
+			// Only a missing file at the default location is acceptable,
+			// every service then has to bring its own certificate.
+			return nil, nil, fmt.Errorf("loading default certificate: %v", err)
+		}
+		def = nil
+	}
+
+	certs := sni.NewMap(nil)
+	if def != nil {
+		defConfig := &tls.Config{GetCertificate: def.GetCertificate}
+		policy.Apply(defConfig)
+		certs.SetDefault(defConfig)
+	}
+	for _, service := range cfg.Services {
+		cert := def
+		if service.CertFile != "" {
+			if cert, err = load(service.CertFile, service.KeyFile); err != nil {
+				return nil, nil, fmt.Errorf("service %s: %v", service.Name, err)
+			}
+		}
+		if cert != nil {
+			cert.AddHost(sni.Hostname(service.IngressUrl))
+		}
+		serviceConfig, err := serviceTLSConfig(service, cert, def)
+		if err != nil {
+			return nil, nil, fmt.Errorf("service %s: %v", service.Name, err)
+		}
+		if serviceConfig != nil {
+			policy.Apply(serviceConfig)
+			certs.Set(service.IngressUrl, serviceConfig)
+		}
+	}
+	return certs, all, nil
+}
+
+// dirCertificates serves the certificates found in cert_dir for their DNS
+// names, except the hosts of services that configure their own certificate
+// or client authentication. The names follow the certificates: a renewal
+// dropping a name, or the removal of the files, stops serving it.
+type dirCertificates struct {
+	certs      *sni.Map
+	policy     tlspolicy.Policy
+	configured map[string]bool
+	names      map[*certwatch.Certificate][]string
+	owner      map[string]*certwatch.Certificate
+}
+
+func newDirCertificates(certs *sni.Map, policy tlspolicy.Policy, services []config.Service) *dirCertificates {
+	configured := map[string]bool{}
+	for _, service := range services {
+		if service.CertFile != "" || service.ClientCA != "" {
+			configured[sni.Hostname(service.IngressUrl)] = true
+		}
+	}
+	return &dirCertificates{
+		certs:      certs,
+		policy:     policy,
+		configured: configured,
+		names:      map[*certwatch.Certificate][]string{},
+		owner:      map[string]*certwatch.Certificate{},
+	}
+}
+
+// serve maps the names c covers now to it and unmaps those it dropped.
+func (d *dirCertificates) serve(c *certwatch.Certificate) {
+	var names []string
+	covered := map[string]bool{}
+	for _, name := range c.Leaf().DNSNames {
+		name = sni.Hostname(name)
+		if d.configured[name] || covered[name] {
+			continue
+		}
+		covered[name] = true
+		names = append(names, name)
+		if d.owner[name] != c {
+			d.set(name, c)
+		}
+	}
+	for _, name := range d.names[c] {
+		if !covered[name] {
+			d.unset(name, c)
+		}
+	}
+	d.names[c] = names
+}
+
+// remove unmaps every name of c.
+func (d *dirCertificates) remove(c *certwatch.Certificate) {
+	names := d.names[c]
+	delete(d.names, c)
+	for _, name := range names {
+		d.unset(name, c)
+	}
+}
+
+func (d *dirCertificates) set(name string, c *certwatch.Certificate) {
+	if prev := d.owner[name]; prev != nil {
+		prev.RemoveHost(name)
+	}
+	config := &tls.Config{GetCertificate: c.GetCertificate}
+	d.policy.Apply(config)
+	d.certs.Set(name, config)
+	d.owner[name] = c
+	c.AddHost(name)
+}
+
+// unset stops serving name with c, handing it to another certificate from
+// cert_dir that still covers it, if any.
+func (d *dirCertificates) unset(name string, c *certwatch.Certificate) {
+	c.RemoveHost(name)
+	if d.owner[name] != c {
+		return
+	}
+	delete(d.owner, name)
+	for other, names := range d.names {
+		for _, n := range names {
+			if n == name && other != c {
+				d.set(name, other)
+				return
+			}
+		}
+	}
+	d.certs.Delete(name)
+}
+
+// serviceTLSConfig returns the TLS config for a service's host, or nil when
+// the service uses the default certificate without client authentication.
+func serviceTLSConfig(service config.Service, cert, def *certwatch.Certificate) (*tls.Config, error) {
+	if cert == def && service.ClientCA == "" {
+		return nil, nil
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("no cert_file and no default certificate")
+	}
+	serviceConfig := &tls.Config{GetCertificate: cert.GetCertificate}
+
+	if service.ClientCA != "" {
+		pool, cas, err := clientcert.LoadCAs(service.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		serviceConfig.ClientCAs = pool
+		switch service.ClientAuth {
+		case "", "require":
+			serviceConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		case "verify_if_given":
+			serviceConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown client_auth '%s'", service.ClientAuth)
+		}
+		if service.ClientCRL != "" {
+			crl, err := clientcert.LoadCRL(service.ClientCRL, cas)
+			if err != nil {
+				return nil, err
+			}
+			serviceConfig.VerifyConnection = crl.VerifyConnection
+		}
+	}
+	return serviceConfig, nil
+}
+
+// upstreamTransport returns the transport for a proxy service, or nil to use
+// the default one when neither upstream_tls nor upstream_protocol is set.
+func upstreamTransport(service config.Service) (http.RoundTripper, error) {
+	opts := service.UpstreamTLS
+	if opts == (config.UpstreamTLS{}) && service.UpstreamProtocol == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if opts.MinVersion != "" {
+		version, err := tlspolicy.ParseVersion(opts.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+	if opts.CAFile != "" {
+		pool, _, err := clientcert.LoadCAs(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	switch service.UpstreamProtocol {
+	case "h2":
+		// HTTP/2 only, the upstream has to accept h2 via ALPN.
+		return &http2.Transport{TLSClientConfig: tlsConfig}, nil
+	case "h2c":
+		// Cleartext HTTP/2 with prior knowledge, for http:// upstreams.
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				dialer := net.Dialer{Timeout: 30 * time.Second}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	switch service.UpstreamProtocol {
+	case "":
+	case "http/1.1":
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	default:
+		return nil, fmt.Errorf("unknown upstream_protocol '%s'", service.UpstreamProtocol)
+	}
+	return transport, nil
+}
+
+// h2Server returns the HTTP/2 settings of both listeners.
+func h2Server(opts config.HTTP2) *http2.Server {
+	streams := opts.MaxConcurrentStreams
+	if streams == 0 {
+		streams = 250
+	}
+	return &http2.Server{MaxConcurrentStreams: streams}
+}
+
+// tlsPolicy builds the listener's handshake policy from the tls block.
+// Unless the tls block lists ALPN protocols, h2 is offered ahead of
+// http/1.1 when HTTP/2 is enabled.
+func tlsPolicy(opts config.TLS, h2 config.HTTP2) (tlspolicy.Policy, error) {
+	policy, err := tlspolicy.Profile(opts.Profile)
+	if err != nil {
+		return policy, err
+	}
+	if opts.MinVersion != "" {
+		if policy.MinVersion, err = tlspolicy.ParseVersion(opts.MinVersion); err != nil {
+			return policy, err
+		}
+	}
+	if opts.MaxVersion != "" {
+		if policy.MaxVersion, err = tlspolicy.ParseVersion(opts.MaxVersion); err != nil {
+			return policy, err
+		}
+	}
+	if len(opts.CipherSuites) > 0 {
+		if policy.CipherSuites, err = tlspolicy.ParseCipherSuites(opts.CipherSuites); err != nil {
+			return policy, err
+		}
+	}
+	if len(opts.Curves) > 0 {
+		if policy.CurvePreferences, err = tlspolicy.ParseCurves(opts.Curves); err != nil {
+			return policy, err
+		}
+	}
+	policy.NextProtos = opts.ALPN
+	if len(policy.NextProtos) == 0 {
+		policy.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if h2.Disable {
+		var protos []string
+		for _, proto := range policy.NextProtos {
+			if proto != "h2" {
+				protos = append(protos, proto)
+			}
+		}
+		policy.NextProtos = protos
+	}
+	policy.SessionTicketsDisabled = opts.DisableSessionTickets
+	return policy, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/allnash/moxie/config"
+	"github.com/allnash/moxie/fastcgi"
+	"github.com/allnash/moxie/uwsgi"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxied reports whether service is served by the proxy middleware.
+func proxied(service config.Service) bool {
+	switch service.Type {
+	case "proxy", "uwsgi", "fastcgi", "grpc":
+		return true
+	}
+	return false
+}
+
+// upstreamTarget returns the URL and transport a proxied service forwards
+// to. HTTP upstreams use upstreamTransport, unix:// upstreams the same over
+// a Unix socket, uwsgi:// and fastcgi:// upstreams, and their +unix
+// variants, a gateway protocol transport. A 'uwsgi' or 'fastcgi' service
+// may also give a bare host:port or socket path as egress_url. FastCGI
+// stderr is logged to logger.
+func upstreamTarget(service config.Service, logger fastcgi.Logger) (*url.URL, http.RoundTripper, error) {
+	egress := service.EgressUrl
+	gateway := service.Type == "uwsgi" || service.Type == "fastcgi"
+	if gateway && !strings.Contains(egress, "://") {
+		if strings.HasPrefix(egress, "/") {
+			egress = service.Type + "+unix://" + egress
+		} else {
+			egress = service.Type + "://" + egress
+		}
+	}
+	target, err := url.Parse(egress)
+	if err != nil {
+		return nil, nil, err
+	}
+	if service.Type == "grpc" && service.UpstreamProtocol == "" {
+		// gRPC needs HTTP/2 to the upstream as well.
+		service.UpstreamProtocol = "h2c"
+		if target.Scheme == "https" {
+			service.UpstreamProtocol = "h2"
+		}
+	}
+	network, address := "tcp", target.Host
+	if target.Scheme == "unix" || strings.HasSuffix(target.Scheme, "+unix") {
+		// The socket path must not become part of the request path, so the
+		// target only keeps the scheme.
+		network, address = "unix", target.Path
+		target = &url.URL{Scheme: target.Scheme, Host: "localhost"}
+	}
+
+	switch target.Scheme {
+	case "uwsgi", "uwsgi+unix":
+		return target, &uwsgi.Transport{
+			Network: network,
+			Address: address,
+			Params:  service.UpstreamParams,
+		}, nil
+	case "fastcgi", "fastcgi+unix":
+		return target, &fastcgi.Transport{
+			Network:   network,
+			Address:   address,
+			Root:      service.FastCGI.Root,
+			SplitPath: service.FastCGI.SplitPath,
+			Index:     service.FastCGI.Index,
+			Params:    service.UpstreamParams,
+			Name:      service.Name,
+			Logger:    logger,
+		}, nil
+	}
+	if gateway {
+		return nil, nil, fmt.Errorf("service %s: egress_url '%s' is not a %s address", service.Name, service.EgressUrl, service.Type)
+	}
+	transport, err := upstreamTransport(service)
+	if err != nil {
+		return nil, nil, err
+	}
+	if network == "unix" {
+		target.Scheme = "http"
+		transport, err = unixTransport(transport, address)
+		if err != nil {
+			return nil, nil, fmt.Errorf("service %s: %v", service.Name, err)
+		}
+	}
+	return target, transport, nil
+}
+
+// unixTransport makes transport, as returned by upstreamTransport, dial the
+// Unix socket at path instead of the target host.
+func unixTransport(transport http.RoundTripper, path string) (http.RoundTripper, error) {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	switch t := transport.(type) {
+	case nil:
+		clone := http.DefaultTransport.(*http.Transport).Clone()
+		clone.DialContext = dial
+		return clone, nil
+	case *http.Transport:
+		t.DialContext = dial
+		return t, nil
+	case *http2.Transport:
+		if !t.AllowHTTP {
+			return nil, errors.New("upstream_protocol h2 needs TLS, use h2c over a Unix socket")
+		}
+		t.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unsupported transport %T", transport)
+}
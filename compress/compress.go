@@ -0,0 +1,386 @@
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Config defines the config for Compress middleware.
+//
+// Responses are compressed with the encoding the client prefers in its
+// Accept-Encoding, ties going to the one listed first in Encodings.
+// Responses already encoded, partial content and media types that are
+// compressed already are sent as they are. Vary: Accept-Encoding is set on
+// every response that could have been compressed, so caches keep the
+// encodings apart, and a strong ETag of a compressed response is made weak,
+// as the tag names the uncompressed bytes ranges are taken from.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// Encodings to compress with, preferred first, out of "br", "zstd" and
+	// "gzip".
+	// default ["br", "zstd", "gzip"]
+	Encodings []string
+
+	// MinLength is the size in bytes under which responses are not worth
+	// compressing.
+	// default 1024
+	MinLength int
+
+	// SkipTypes are media types not compressed, like "image/png", or
+	// whole top-level types, like "video/*".
+	// default DefaultSkipTypes
+	SkipTypes []string
+}
+
+// DefaultSkipTypes are media types whose content is compressed already.
+var DefaultSkipTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif",
+	"image/heic", "image/heif", "image/jxl",
+	"video/*", "audio/*",
+	"font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-bzip2", "application/x-xz", "application/zstd",
+	"application/x-7z-compressed", "application/vnd.rar",
+	"application/x-rar-compressed", "application/pdf",
+}
+
+// DefaultConfig is the default Compress middleware config
+var DefaultConfig = Config{
+	Skipper:   middleware.DefaultSkipper,
+	Encodings: []string{"br", "zstd", "gzip"},
+	MinLength: 1024,
+	SkipTypes: DefaultSkipTypes,
+}
+
+// Encoder levels, balancing ratio against the CPU spent on every response.
+const (
+	gzipLevel   = 5
+	brotliLevel = 4
+)
+
+var encoders = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(io.Discard, gzipLevel)
+		return w
+	}},
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, brotliLevel)
+	}},
+	"zstd": {New: func() interface{} {
+		w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+		return w
+	}},
+}
+
+// encoder is implemented by the writers of every encoding.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Middleware returns a Compress middleware.
+func Middleware() echo.MiddlewareFunc {
+	return MiddlewareWithConfig(DefaultConfig)
+}
+
+// MiddlewareWithConfig returns a Compress middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+	if len(config.Encodings) == 0 {
+		config.Encodings = DefaultConfig.Encodings
+	}
+	for _, encoding := range config.Encodings {
+		if encoders[encoding] == nil {
+			panic("echo: compress middleware does not support encoding " + encoding)
+		}
+	}
+	if config.MinLength == 0 {
+		config.MinLength = DefaultConfig.MinLength
+	}
+	if config.SkipTypes == nil {
+		config.SkipTypes = DefaultConfig.SkipTypes
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) {
+				return next(c)
+			}
+			res := c.Response()
+			w := &responseWriter{
+				ResponseWriter: res.Writer,
+				config:         &config,
+				encoding:       Negotiate(c.Request().Header.Get(echo.HeaderAcceptEncoding), config.Encodings),
+				head:           c.Request().Method == http.MethodHead,
+				ifNoneMatch:    c.Request().Header.Get("If-None-Match"),
+			}
+			res.Writer = w
+			defer func() {
+				w.finish()
+				res.Writer = w.ResponseWriter
+			}()
+			return next(c)
+		}
+	}
+}
+
+// Negotiate returns the encoding out of offered, preferred first, the client
+// accepts most according to its Accept-Encoding, empty when it accepts none.
+func Negotiate(acceptEncoding string, offered []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	q := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		value := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(name, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					value = f
+				}
+			}
+		}
+		q[coding] = value
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		v, ok := q[encoding]
+		if !ok {
+			v = q["*"]
+		}
+		if v > bestQ {
+			best, bestQ = encoding, v
+		}
+	}
+	return best
+}
+
+// responseWriter decides whether to compress once the headers are final
+// and, without a Content-Length, enough of the body is written to know it
+// is worth it.
+type responseWriter struct {
+	http.ResponseWriter
+	config      *Config
+	encoding    string // negotiated, empty when the client accepts none
+	head        bool
+	ifNoneMatch string
+
+	code    int
+	decided bool
+	buf     []byte
+	enc     encoder
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.decided || w.code != 0 {
+		return
+	}
+	if code < http.StatusOK {
+		// Informational responses precede the final one.
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.code = code
+	if w.head || !bodyAllowed(code) || w.Header().Get(echo.HeaderContentLength) != "" {
+		w.decide()
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) >= w.config.MinLength {
+			if err := w.decide(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the header, compressed when the response is worth it, and
+// whatever body is buffered.
+func (w *responseWriter) decide() error {
+	w.decided = true
+	h := w.Header()
+	if h.Get(echo.HeaderContentType) == "" && len(w.buf) > 0 {
+		// Sniff now, net/http would sniff the compressed bytes.
+		h.Set(echo.HeaderContentType, http.DetectContentType(w.buf))
+	}
+	if w.code == http.StatusNotModified {
+		w.notModified()
+	} else if w.compressible() {
+		addVary(h, echo.HeaderAcceptEncoding)
+		if w.encoding != "" && w.code != http.StatusPartialContent && w.longEnough() {
+			// The bytes differ from those the strong tag names, ranges
+			// of them are not ranges of the file.
+			if tag := h.Get("ETag"); tag != "" && !strings.HasPrefix(tag, "W/") {
+				h.Set("ETag", "W/"+tag)
+			}
+			h.Del(echo.HeaderContentLength)
+			h.Del("Accept-Ranges")
+			h.Set(echo.HeaderContentEncoding, w.encoding)
+			if !w.head {
+				w.enc = encoders[w.encoding].Get().(encoder)
+				w.enc.Reset(w.ResponseWriter)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// notModified gives a 304 the weak tag the client validated with when it
+// stands for a compressed response, as a 200 would have carried it.
+func (w *responseWriter) notModified() {
+	h := w.Header()
+	tag := h.Get("ETag")
+	if w.encoding == "" || tag == "" || strings.HasPrefix(tag, "W/") {
+		return
+	}
+	for _, field := range strings.Split(w.ifNoneMatch, ",") {
+		if strings.TrimSpace(field) == "W/"+tag {
+			h.Set("ETag", "W/"+tag)
+			addVary(h, echo.HeaderAcceptEncoding)
+			return
+		}
+	}
+}
+
+// compressible reports whether the response, or a full response for a
+// partial one, may be compressed for clients accepting it.
+func (w *responseWriter) compressible() bool {
+	h := w.Header()
+	if !bodyAllowed(w.code) {
+		return false
+	}
+	if h.Get(echo.HeaderContentEncoding) != "" {
+		return false
+	}
+	if strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	mediaType := h.Get(echo.HeaderContentType)
+	if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, skip := range w.config.SkipTypes {
+		if mediaType == skip || strings.HasSuffix(skip, "/*") && strings.HasPrefix(mediaType, skip[:len(skip)-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// longEnough reports whether the body reaches MinLength, by its
+// Content-Length or what has been buffered of it.
+func (w *responseWriter) longEnough() bool {
+	if n, err := strconv.Atoi(w.Header().Get(echo.HeaderContentLength)); err == nil {
+		return n >= w.config.MinLength
+	}
+	return len(w.buf) >= w.config.MinLength
+}
+
+// finish decides for responses shorter than MinLength and ends the
+// compressed stream.
+func (w *responseWriter) finish() {
+	if w.code == 0 {
+		// Nothing written, leave the response to the error handler.
+		return
+	}
+	if !w.decided {
+		w.decide()
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(io.Discard)
+		encoders[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+// Flush sends what is compressed so far, streamed responses are compressed
+// whatever their length.
+func (w *responseWriter) Flush() {
+	if w.code == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide()
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// bodyAllowed reports whether a response with status code has a body.
+func bodyAllowed(code int) bool {
+	return code >= http.StatusOK && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// addVary adds value to the Vary header unless it is listed already.
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values(echo.HeaderVary) {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, value) {
+				return
+			}
+		}
+	}
+	h.Add(echo.HeaderVary, value)
+}
@@ -1,18 +1,186 @@
 package config
 
 type Config struct {
-	Version         string    `yaml:"version"`
-	StatusHost      string    `yaml:"status_host"`
-	ProxyListenPort string    `yaml:"proxy_listen_port"`
-	Logfile         string    `yaml:"log_file"`
-	Services        []Service `yaml:"services"`
+	Version         string         `yaml:"version"`
+	StatusHost      string         `yaml:"status_host"`
+	ProxyListenPort string         `yaml:"proxy_listen_port"`
+	Logfile         string         `yaml:"log_file"`
+	SSLPort         string         `yaml:"ssl_port"`       // SSLPort enables the TLS listener, e.g. "443"
+	SSLCertFile     string         `yaml:"ssl_cert_file"`  // SSLCertFile is the default certificate, default is "/etc/moxie/ssl/server.crt"
+	SSLKeyFile      string         `yaml:"ssl_key_file"`   // SSLKeyFile is the default key, default is "/etc/moxie/ssl/server.key"
+	TLS             TLS            `yaml:"tls"`            // TLS is the handshake policy of the TLS listener
+	HTTP2           HTTP2          `yaml:"http2"`          // HTTP2 configures HTTP/2 on the listeners
+	HTTP3           HTTP3          `yaml:"http3"`          // HTTP3 configures HTTP/3 over QUIC on the ssl_port
+	UnixListeners   []UnixListener `yaml:"unix_listeners"` // UnixListeners serve the same hosts on Unix sockets, e.g. behind a local load balancer
+	Services        []Service      `yaml:"services"`
+}
+
+type UnixListener struct {
+	Path     string `yaml:"path"`      // Path of the socket, a stale socket left by an earlier run is replaced
+	TLS      bool   `yaml:"tls"`       // TLS serves the ssl_port certificates and policy on the socket, requires ssl_port
+	Mode     string `yaml:"mode"`      // Mode is the octal permission of the socket, default is '0660'
+	Owner    string `yaml:"owner"`     // Owner is a user name or uid, default is the user moxie runs as
+	Group    string `yaml:"group"`     // Group is a group name or gid, default is the group moxie runs as
+	PeerAddr string `yaml:"peer_addr"` // PeerAddr is the IP peers are reported as, e.g. '127.0.0.1' for IP rules to match them, default is the socket path, which IP filters let through
+}
+
+type TLS struct {
+	Profile               string   `yaml:"profile"`                 // Profile is one of ['modern', 'intermediate'], default is 'modern'
+	MinVersion            string   `yaml:"min_version"`             // MinVersion overrides the profile, one of ['1.0', '1.1', '1.2', '1.3']
+	MaxVersion            string   `yaml:"max_version"`             // MaxVersion overrides the profile, one of ['1.0', '1.1', '1.2', '1.3']
+	CipherSuites          []string `yaml:"cipher_suites"`           // CipherSuites for TLS 1.2, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	Curves                []string `yaml:"curves"`                  // Curves in preference order, e.g. ['X25519MLKEM768', 'X25519', 'P-256'], default is Go's
+	ALPN                  []string `yaml:"alpn"`                    // ALPN protocols offered, e.g. ['http/1.1']
+	SessionTicketKeyFile  string   `yaml:"session_ticket_key_file"` // SessionTicketKeyFile holds base64 32 byte keys, newest first, re-read on change
+	DisableSessionTickets bool     `yaml:"disable_session_tickets"` // DisableSessionTickets turns off TLS session resumption via tickets
+	DisableOCSPStapling   bool     `yaml:"disable_ocsp_stapling"`   // DisableOCSPStapling stops fetching OCSP responses for certificates
+	ExpiryWarningDays     []int    `yaml:"expiry_warning_days"`     // ExpiryWarningDays log a warning as a certificate nears expiry, default is [30, 7, 1]
+	CertDir               string   `yaml:"cert_dir"`                // CertDir is watched for NAME.crt and NAME.key pairs, default is '/etc/moxie/ssl'
+}
+
+type HTTP2 struct {
+	Disable              bool   `yaml:"disable"`                // Disable turns off HTTP/2 on the TLS listener, which is negotiated via ALPN by default
+	H2C                  bool   `yaml:"h2c"`                    // H2C serves cleartext HTTP/2 on the plain listener, by prior knowledge or Upgrade
+	MaxConcurrentStreams uint32 `yaml:"max_concurrent_streams"` // MaxConcurrentStreams per client connection, default is 250
+}
+
+type HTTP3 struct {
+	Enable     bool `yaml:"enable"`       // Enable serves HTTP/3 on UDP ssl_port and advertises it with Alt-Svc on TLS responses
+	AltSvcPort int  `yaml:"alt_svc_port"` // AltSvcPort is advertised instead of ssl_port, e.g. when UDP traffic is port mapped
 }
 
 type Service struct {
 	Name          string `yaml:"name"`
-	Type          string `yaml:"type"` // Type is one of ['web', 'proxy', 'static']
+	Type          string `yaml:"type"` // Type is one of ['web', 'proxy', 'uwsgi', 'fastcgi', 'grpc', 'static', 'tcp', 'udp', 'passthrough']
 	IngressUrl    string `yaml:"ingress_url"`
 	EgressUrl     string `yaml:"egress_url"`
 	XFrameOptions string `yaml:"x_frame_options"` // XFrameOptions is one of ['DENY', 'SAMEORIGIN', 'ALLOW-FROM']
 	HSTSMaxAge    int    `yaml:"hsts_max_age"`    // HSTSMaxAge is the max age in seconds
+
+	ForceHTTPS            bool `yaml:"force_https"`             // ForceHTTPS redirects plain HTTP requests to the TLS listener, except ACME challenges, requires ssl_port
+	HSTSExcludeSubdomains bool `yaml:"hsts_exclude_subdomains"` // HSTSExcludeSubdomains leaves includeSubDomains out of the HSTS header
+	HSTSPreload           bool `yaml:"hsts_preload"`            // HSTSPreload adds preload, requires hsts_max_age of at least 31536000
+
+	TrustedProxies []string `yaml:"trusted_proxies"` // TrustedProxies are IPs or CIDRs of proxies terminating TLS in front, whose X-Forwarded-Proto force_https believes
+
+	CertFile   string `yaml:"cert_file"`   // CertFile replaces the default certificate for this service's host
+	KeyFile    string `yaml:"key_file"`    // KeyFile is the key for CertFile
+	ClientCA   string `yaml:"client_ca"`   // ClientCA is a PEM bundle of CAs that issue client certificates
+	ClientAuth string `yaml:"client_auth"` // ClientAuth is one of ['require', 'verify_if_given'], default is 'require'
+	ClientCRL  string `yaml:"client_crl"`  // ClientCRL is a PEM or DER CRL signed by ClientCA, to be replaced before its next update
+
+	UpstreamTLS      UpstreamTLS `yaml:"upstream_tls"`      // UpstreamTLS configures TLS toward an https:// EgressUrl
+	UpstreamProtocol string      `yaml:"upstream_protocol"` // UpstreamProtocol is one of ['', 'http/1.1', 'h2', 'h2c'], default negotiates h2 or http/1.1 over https
+	WebSocket        WebSocket   `yaml:"websocket"`         // WebSocket limits the upgraded connections of a proxy service
+
+	UpstreamParams map[string]string `yaml:"upstream_params"` // UpstreamParams add or override the CGI variables sent to uwsgi and FastCGI upstreams, e.g. {"UWSGI_SCRIPT": "mysite.wsgi"}
+	FastCGI        FastCGI           `yaml:"fastcgi"`         // FastCGI maps request paths to scripts for FastCGI upstreams
+	GRPC           GRPC              `yaml:"grpc"`            // GRPC routes and translates requests of 'grpc' services
+	Compression    Compression       `yaml:"compression"`     // Compression of 'static' services, on the fly and from precompressed files
+	CacheControl   CacheControl      `yaml:"cache_control"`   // CacheControl sets Cache-Control on the responses of 'static' services by path
+	Manifest       Manifest          `yaml:"manifest"`        // Manifest serves the hashed files of Django's ManifestStaticFilesStorage for 'static' services
+	Stream         Stream            `yaml:"stream"`          // Stream configures 'tcp' and 'udp' services, which listen on their own port, and 'passthrough' services, which take ingress_url from ssl_port without terminating TLS
+
+	FlushInterval      int            `yaml:"flush_interval"`       // FlushInterval in milliseconds between flushes to the client, -1 flushes every write, default buffers
+	FlushIntervalPaths map[string]int `yaml:"flush_interval_paths"` // FlushIntervalPaths overrides FlushInterval for path prefixes, e.g. {"/events/": -1}
+
+	Auth               string   `yaml:"auth"`                 // Auth is one of ['', 'basic', 'forward', 'jwt', 'oidc']
+	AuthPaths          []string `yaml:"auth_paths"`           // AuthPaths limits auth to these path prefixes, default is every path
+	AuthExemptPaths    []string `yaml:"auth_exempt_paths"`    // AuthExemptPaths are path prefixes served without auth
+	AuthExemptIPs      []string `yaml:"auth_exempt_ips"`      // AuthExemptIPs are IPs or CIDRs served without auth
+	AuthRealm          string   `yaml:"auth_realm"`           // AuthRealm is the basic auth realm, default is "Restricted"
+	HtpasswdFile       string   `yaml:"htpasswd_file"`        // HtpasswdFile holds bcrypt, SHA or apr1 hashes for auth 'basic'
+	ForwardAuthURL     string   `yaml:"forward_auth_url"`     // ForwardAuthURL is asked to authorize each request for auth 'forward'
+	ForwardAuthHeaders []string `yaml:"forward_auth_headers"` // ForwardAuthHeaders are copied from the auth response to the upstream request, e.g. X-User
+	JWT                JWT      `yaml:"jwt"`                  // JWT configures bearer token validation for auth 'jwt'
+	OIDC               OIDC     `yaml:"oidc"`                 // OIDC configures the login gateway for auth 'oidc'
+}
+
+type FastCGI struct {
+	Root      string   `yaml:"root"`       // Root is the document root on the FastCGI server, SCRIPT_FILENAME is root followed by SCRIPT_NAME
+	SplitPath []string `yaml:"split_path"` // SplitPath splits the path after these extensions into SCRIPT_NAME and PATH_INFO, e.g. [".php"]
+	Index     string   `yaml:"index"`      // Index is the script for paths ending in a slash, e.g. "index.php"
+}
+
+type GRPC struct {
+	Web    bool              `yaml:"web"`    // Web translates gRPC-Web requests from browsers into gRPC calls
+	Routes map[string]string `yaml:"routes"` // Routes send gRPC services to their own upstream, e.g. {"helloworld.Greeter": "http://localhost:50051"}
+}
+
+type Compression struct {
+	Disable       bool     `yaml:"disable"`       // Disable turns off compressing responses on the fly, precompressed files are still served
+	Encodings     []string `yaml:"encodings"`     // Encodings compressed on the fly, preferred first, default is ['br', 'zstd', 'gzip']
+	MinLength     int      `yaml:"min_length"`    // MinLength in bytes of responses worth compressing, default is 1024
+	SkipTypes     []string `yaml:"skip_types"`    // SkipTypes are media types not compressed, e.g. 'image/png' or 'video/*', default lists those compressed already
+	Precompressed []string `yaml:"precompressed"` // Precompressed are the encodings whose '.br', '.zst' and '.gz' siblings of files are served, default is ['br', 'zstd', 'gzip']
+}
+
+type CacheControl struct {
+	Default string      `yaml:"default"` // Default is the Cache-Control of paths matching no rule, default is 'public, max-age=3600'
+	Rules   []CacheRule `yaml:"rules"`   // Rules apply in order, the first matching a path wins
+	Expires bool        `yaml:"expires"` // Expires adds an Expires header matching max-age for HTTP/1.0 caches
+	Disable bool        `yaml:"disable"` // Disable sends 'no-store' on every response
+}
+
+type CacheRule struct {
+	Glob       string   `yaml:"glob"`       // Glob matches the file name, e.g. '*.html', or the path when it has a slash, e.g. '/media/*/*.jpg'
+	Regex      string   `yaml:"regex"`      // Regex matches anywhere in the path, e.g. '\.[0-9a-f]{12}\.js$'
+	Extensions []string `yaml:"extensions"` // Extensions match the end of the path, e.g. ['.woff2', '.png']
+	Value      string   `yaml:"value"`      // Value is the Cache-Control, e.g. 'public, max-age=31536000, immutable' or 'no-cache'
+}
+
+type Manifest struct {
+	File           string `yaml:"file"`            // File is the staticfiles.json of collectstatic, relative to egress_url, e.g. 'staticfiles.json'
+	Unhashed       string `yaml:"unhashed"`        // Unhashed is one of ['serve', 'redirect', 'rewrite'] for requests of original names, default is 'serve'
+	ReloadInterval int    `yaml:"reload_interval"` // ReloadInterval in seconds between checks of File for a new collectstatic, default is 10
+}
+
+type Stream struct {
+	Listen              string              `yaml:"listen"`                // Listen is the address to serve, e.g. ':5432'
+	Upstreams           []string            `yaml:"upstreams"`             // Upstreams are host:port addresses balanced round robin, default is egress_url
+	TLS                 string              `yaml:"tls"`                   // TLS is one of ['', 'terminate'], terminate serves the ssl_port certificates
+	SNIRoutes           map[string][]string `yaml:"sni_routes"`            // SNIRoutes pass TLS through by ClientHello server name, e.g. {"db1.example.com": ["10.0.0.5:5432"]}
+	HealthCheckInterval int                 `yaml:"health_check_interval"` // HealthCheckInterval in seconds between TCP connect checks of the upstreams, default is 10 for tcp and off for udp, -1 disables
+	IdleTimeout         int                 `yaml:"idle_timeout"`          // IdleTimeout in seconds closes idle connections and UDP sessions, default is 300 for tcp and 60 for udp
+	MaxSessions         int                 `yaml:"max_sessions"`          // MaxSessions of a 'udp' service, datagrams of new clients are dropped beyond it, default is 1024
+}
+
+type JWT struct {
+	JWKSURL       string            `yaml:"jwks_url"`       // JWKSURL is fetched and cached for verification keys
+	JWKSFile      string            `yaml:"jwks_file"`      // JWKSFile is a local JWKS used instead of JWKSURL
+	Secret        string            `yaml:"secret"`         // Secret is the HS256 shared secret
+	Algorithms    []string          `yaml:"algorithms"`     // Algorithms accepted, default is ['HS256', 'RS256', 'ES256']
+	Issuer        string            `yaml:"issuer"`         // Issuer must match the iss claim when set
+	Audience      []string          `yaml:"audience"`       // Audience must contain the aud claim when set
+	Leeway        int               `yaml:"leeway"`         // Leeway is the allowed clock skew in seconds for exp and nbf
+	ClaimsHeaders map[string]string `yaml:"claims_headers"` // ClaimsHeaders maps claims to upstream request headers, e.g. sub: X-User
+}
+
+type OIDC struct {
+	Issuer         string            `yaml:"issuer"`          // Issuer is the OpenID provider URL used for discovery
+	ClientID       string            `yaml:"client_id"`       // ClientID registered with the issuer
+	ClientSecret   string            `yaml:"client_secret"`   // ClientSecret registered with the issuer
+	RedirectURL    string            `yaml:"redirect_url"`    // RedirectURL default is /oauth2/callback on the scheme and host of the request
+	Scopes         []string          `yaml:"scopes"`          // Scopes default is ['openid', 'email', 'profile']
+	CookieName     string            `yaml:"cookie_name"`     // CookieName default is "moxie_session"
+	CookieSecret   string            `yaml:"cookie_secret"`   // CookieSecret encrypts the session cookie, at least 16 characters
+	AllowedDomains []string          `yaml:"allowed_domains"` // AllowedDomains restricts users by verified email domain
+	AllowedGroups  []string          `yaml:"allowed_groups"`  // AllowedGroups restricts users by group membership
+	GroupsClaim    string            `yaml:"groups_claim"`    // GroupsClaim default is "groups"
+	ClaimsHeaders  map[string]string `yaml:"claims_headers"`  // ClaimsHeaders maps claims to upstream request headers, e.g. email: X-Email
+}
+
+type WebSocket struct {
+	IdleTimeout    int `yaml:"idle_timeout"`    // IdleTimeout in seconds closes connections without traffic either way, default is no timeout
+	MaxLifetime    int `yaml:"max_lifetime"`    // MaxLifetime in seconds closes connections that long after the upgrade, default is no limit
+	MaxConnections int `yaml:"max_connections"` // MaxConnections caps concurrent connections, further upgrades get a 503, default is no limit
+}
+
+type UpstreamTLS struct {
+	CAFile             string `yaml:"ca_file"`              // CAFile is a PEM bundle trusted instead of the system roots
+	CertFile           string `yaml:"cert_file"`            // CertFile is a client certificate presented to the upstream
+	KeyFile            string `yaml:"key_file"`             // KeyFile is the key for CertFile
+	ServerName         string `yaml:"server_name"`          // ServerName overrides the SNI and verified name, default is the EgressUrl host
+	MinVersion         string `yaml:"min_version"`          // MinVersion is one of ['1.0', '1.1', '1.2', '1.3'], default is '1.2'
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // InsecureSkipVerify disables certificate checks, for lab setups only
 }
@@ -0,0 +1,554 @@
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/allnash/moxie/cgienv"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives the lines an application writes to FastCGI stderr.
+type Logger interface {
+	Warnf(format string, args ...interface{})
+}
+
+// Transport is an http.RoundTripper that forwards requests to a FastCGI
+// server such as php-fpm. The request is sent as CGI variables (see cgienv)
+// and stdin, the application's stdout is parsed as a CGI response and its
+// stderr is logged.
+//
+// Connections are kept open with FCGI_KEEP_CONN and reused, one request at
+// a time.
+type Transport struct {
+	// Network is "tcp" or "unix".
+	// Required.
+	Network string
+
+	// Address is a host:port or a socket path.
+	// Required.
+	Address string
+
+	// Root is the document root on the FastCGI server. SCRIPT_FILENAME is
+	// set to Root followed by SCRIPT_NAME.
+	// Optional.
+	Root string
+
+	// SplitPath splits the request path after the first of these
+	// extensions that ends a path segment into SCRIPT_NAME and PATH_INFO,
+	// like nginx's fastcgi_split_path_info, e.g. ".php" maps
+	// /index.php/users to the script /index.php with PATH_INFO /users.
+	// Optional.
+	SplitPath []string
+
+	// Index is appended to paths ending in a slash to name the script.
+	// Optional.
+	Index string
+
+	// Params override or add FastCGI variables, and may reference the
+	// others, e.g. "SCRIPT_FILENAME": "/srv/app${SCRIPT_NAME}".
+	// Optional.
+	Params map[string]string
+
+	// Name prefixes the logged stderr lines.
+	// Optional.
+	Name string
+
+	// Logger receives stderr.
+	// Optional, stderr is dropped without it.
+	Logger Logger
+
+	// DialTimeout limits connecting to the server.
+	// default 30 seconds
+	DialTimeout time.Duration
+
+	// MaxIdleConns is the number of idle connections kept for reuse.
+	// default 16
+	MaxIdleConns int
+
+	// MaxMemoryBody is the largest request body of unknown length that is
+	// buffered in memory to compute its CONTENT_LENGTH, larger bodies are
+	// buffered in a temporary file.
+	// default 1 MB
+	MaxMemoryBody int64
+
+	mu   sync.Mutex
+	idle []*idleConn
+}
+
+// Record types and values of the FastCGI 1.0 specification.
+const (
+	typeBeginRequest = 1
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+
+	roleResponder   = 1
+	flagKeepConn    = 1
+	requestComplete = 0
+
+	// requestID is constant as a connection carries one request at a time.
+	requestID     = 1
+	maxRecordSize = 65535
+)
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	closeBody := func() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+	}
+	maxMemory := t.MaxMemoryBody
+	if maxMemory == 0 {
+		maxMemory = 1 << 20
+	}
+	body, length, cleanup, err := cgienv.Body(req, maxMemory)
+	if err != nil {
+		closeBody()
+		return nil, err
+	}
+	sized := *req
+	sized.ContentLength = length
+	env := cgienv.Build(&sized, nil)
+	if err := t.script(env); err != nil {
+		closeBody()
+		cleanup()
+		return nil, err
+	}
+	cgienv.Apply(env, t.Params)
+
+	conn, err := t.conn(req)
+	if err != nil {
+		closeBody()
+		cleanup()
+		return nil, err
+	}
+	x := &exchange{
+		t:         t,
+		conn:      conn,
+		cleanup:   cleanup,
+		stdinDone: make(chan struct{}),
+		done:      make(chan struct{}),
+		watching:  make(chan struct{}),
+	}
+	go x.watch(req)
+
+	w := &recordWriter{w: conn}
+	if err := x.sendHeader(w, env); err != nil {
+		closeBody()
+		close(x.stdinDone)
+		x.finish(false)
+		return nil, err
+	}
+	// Stdin is sent while the response is read, an application may answer
+	// before it consumed the whole body.
+	go func() {
+		defer close(x.stdinDone)
+		defer closeBody()
+		if body != nil {
+			if _, err := io.Copy(&streamWriter{w: w, typ: typeStdin}, body); err != nil {
+				return
+			}
+		}
+		w.write(typeStdin, nil)
+	}()
+
+	pr, pw := io.Pipe()
+	go x.read(pw)
+	br := bufio.NewReader(pr)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		pr.Close()
+		x.finish(false)
+		return nil, fmt.Errorf("fastcgi: reading response: %v", err)
+	}
+	res, err := response(req, http.Header(header))
+	if err != nil {
+		pr.Close()
+		x.finish(false)
+		return nil, err
+	}
+	res.Body = &responseBody{Reader: br, pipe: pr, x: x}
+	return res, nil
+}
+
+// script sets SCRIPT_NAME, PATH_INFO and SCRIPT_FILENAME from Index,
+// SplitPath and Root. The request path is cleaned first so dot-dot
+// segments cannot name a script outside Root.
+func (t *Transport) script(env map[string]string) error {
+	scriptName, pathInfo := cleanPath(env["PATH_INFO"]), ""
+	for _, ext := range t.SplitPath {
+		if end := splitIndex(scriptName, ext); end >= 0 {
+			scriptName, pathInfo = scriptName[:end], scriptName[end:]
+			break
+		}
+	}
+	if t.Index != "" && strings.HasSuffix(scriptName, "/") {
+		scriptName += t.Index
+	}
+	env["SCRIPT_NAME"] = scriptName
+	env["PATH_INFO"] = pathInfo
+	if t.Root != "" {
+		env["DOCUMENT_ROOT"] = t.Root
+		filename := path.Join(t.Root, scriptName)
+		root := path.Clean(t.Root)
+		if filename != root && !strings.HasPrefix(filename, strings.TrimSuffix(root, "/")+"/") {
+			return fmt.Errorf("fastcgi: script %s is outside root %s", scriptName, t.Root)
+		}
+		env["SCRIPT_FILENAME"] = filename
+	}
+	return nil
+}
+
+// splitIndex returns the end of the first occurrence of ext in p, ignoring
+// case, that ends p or a segment of it, or -1. /a.php.d/b.php splits after
+// b.php, the first .php not ending a segment is passed over.
+func splitIndex(p, ext string) int {
+	if ext == "" {
+		return -1
+	}
+	for end := len(ext); end <= len(p); end++ {
+		if (end == len(p) || p[end] == '/') && strings.EqualFold(p[end-len(ext):end], ext) {
+			return end
+		}
+	}
+	return -1
+}
+
+// cleanPath returns p cleaned and rooted, keeping a trailing slash.
+func cleanPath(p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// conn returns an idle connection or dials a new one.
+func (t *Transport) conn(req *http.Request) (net.Conn, error) {
+	t.mu.Lock()
+	for len(t.idle) > 0 {
+		c := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		if c.take() {
+			t.mu.Unlock()
+			return c.Conn, nil
+		}
+	}
+	t.mu.Unlock()
+
+	timeout := t.DialTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(req.Context(), t.Network, t.Address)
+}
+
+// put keeps conn for reuse, or closes it when enough are idle.
+func (t *Transport) put(conn net.Conn) {
+	max := t.MaxIdleConns
+	if max == 0 {
+		max = 16
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle) >= max {
+		conn.Close()
+		return
+	}
+	c := &idleConn{Conn: conn, read: make(chan error, 1)}
+	go c.watch()
+	t.idle = append(t.idle, c)
+}
+
+// idleConn is a pooled connection. The server may close it anytime, e.g.
+// when php-fpm recycles a worker, so it is read from while idle to notice.
+type idleConn struct {
+	net.Conn
+	read chan error
+}
+
+// watch blocks until the server closes the connection or take interrupts
+// it.
+func (c *idleConn) watch() {
+	var one [1]byte
+	n, err := c.Conn.Read(one[:])
+	if n > 0 {
+		err = errors.New("unexpected data on idle connection")
+	}
+	if !isTimeout(err) {
+		c.Conn.Close()
+	}
+	c.read <- err
+}
+
+// take stops watching and reports whether the connection is still usable.
+func (c *idleConn) take() bool {
+	c.Conn.SetReadDeadline(time.Now())
+	err := <-c.read
+	c.Conn.SetReadDeadline(time.Time{})
+	return isTimeout(err)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// exchange is one request on a connection.
+type exchange struct {
+	t         *Transport
+	conn      net.Conn
+	cleanup   func()
+	stdinDone chan struct{}
+
+	done     chan struct{} // closed when the exchange ends
+	watching chan struct{} // closed when watch returns
+	once     sync.Once
+	aborted  bool // set by watch before watching is closed
+}
+
+// watch closes the connection when the client goes away.
+func (x *exchange) watch(req *http.Request) {
+	defer close(x.watching)
+	select {
+	case <-req.Context().Done():
+		x.aborted = true
+		x.conn.Close()
+	case <-x.done:
+	}
+}
+
+// finish ends the exchange and keeps the connection when reusable is set
+// and nothing is left unsent.
+func (x *exchange) finish(reusable bool) {
+	x.once.Do(func() {
+		close(x.done)
+		<-x.watching
+		if reusable && !x.aborted {
+			select {
+			case <-x.stdinDone:
+			default:
+				// The application answered before reading all of stdin.
+				reusable = false
+			}
+		}
+		if reusable && !x.aborted {
+			x.t.put(x.conn)
+		} else {
+			x.conn.Close()
+		}
+		// Stdin may still be copied from the buffer cleanup removes.
+		// Closing conn ends the copy, unless it waits on a client still
+		// sending, which the response must not wait for.
+		go func() {
+			<-x.stdinDone
+			x.cleanup()
+		}()
+	})
+}
+
+// sendHeader sends the begin request and params records.
+func (x *exchange) sendHeader(w *recordWriter, env map[string]string) error {
+	begin := []byte{0, roleResponder, flagKeepConn, 0, 0, 0, 0, 0}
+	if err := w.write(typeBeginRequest, begin); err != nil {
+		return err
+	}
+	params := &streamWriter{w: w, typ: typeParams}
+	buf := make([]byte, 0, 4096)
+	for name, value := range env {
+		buf = appendLength(buf, len(name))
+		buf = appendLength(buf, len(value))
+		buf = append(buf, name...)
+		buf = append(buf, value...)
+	}
+	if _, err := params.Write(buf); err != nil {
+		return err
+	}
+	return w.write(typeParams, nil)
+}
+
+// read copies stdout into pw and logs stderr until the end request record.
+func (x *exchange) read(pw *io.PipeWriter) {
+	stderr := &stderrLogger{t: x.t}
+	defer stderr.flush()
+	r := bufio.NewReader(x.conn)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			pw.CloseWithError(err)
+			x.finish(false)
+			return
+		}
+		typ := header[1]
+		length := int(header[4])<<8 | int(header[5])
+		content := make([]byte, length+int(header[6]))
+		if _, err := io.ReadFull(r, content); err != nil {
+			pw.CloseWithError(err)
+			x.finish(false)
+			return
+		}
+		content = content[:length]
+
+		switch typ {
+		case typeStdout:
+			if _, err := pw.Write(content); err != nil {
+				// The response body was closed early.
+				x.finish(false)
+				return
+			}
+		case typeStderr:
+			stderr.Write(content)
+		case typeEndRequest:
+			if length >= 5 && content[4] != requestComplete {
+				pw.CloseWithError(fmt.Errorf("fastcgi: request not completed, protocol status %d", content[4]))
+				x.finish(false)
+				return
+			}
+			pw.Close()
+			x.finish(r.Buffered() == 0)
+			return
+		}
+	}
+}
+
+// response builds the HTTP response from the CGI response header.
+func response(req *http.Request, header http.Header) (*http.Response, error) {
+	code := http.StatusOK
+	if status := header.Get("Status"); status != "" {
+		var err error
+		if code, err = strconv.Atoi(strings.SplitN(status, " ", 2)[0]); err != nil || code < 100 {
+			return nil, fmt.Errorf("fastcgi: invalid status '%s'", status)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		code = http.StatusFound
+	}
+	res := &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: -1,
+		Request:       req,
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		res.ContentLength = length
+	}
+	return res, nil
+}
+
+// responseBody reads stdout. Closing it before the end of the response
+// closes the connection, which makes the server abort the request.
+type responseBody struct {
+	io.Reader
+	pipe *io.PipeReader
+	x    *exchange
+}
+
+func (b *responseBody) Close() error {
+	err := b.pipe.Close()
+	b.x.finish(false)
+	return err
+}
+
+// recordWriter writes records to a connection.
+type recordWriter struct {
+	w io.Writer
+}
+
+var padding [7]byte
+
+func (w *recordWriter) write(typ byte, content []byte) error {
+	pad := -len(content) & 7
+	header := []byte{1, typ, 0, requestID, byte(len(content) >> 8), byte(len(content)), byte(pad), 0}
+	if _, err := w.w.Write(append(append(header, content...), padding[:pad]...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// streamWriter splits a stream into records of one type.
+type streamWriter struct {
+	w   *recordWriter
+	typ byte
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordSize {
+			chunk = chunk[:maxRecordSize]
+		}
+		if err := s.w.write(s.typ, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// appendLength encodes a name or value length.
+func appendLength(buf []byte, n int) []byte {
+	if n < 128 {
+		return append(buf, byte(n))
+	}
+	return append(buf, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// stderrLogger logs stderr line by line.
+type stderrLogger struct {
+	t    *Transport
+	line []byte
+}
+
+func (l *stderrLogger) Write(p []byte) {
+	l.line = append(l.line, p...)
+	for {
+		i := bytes.IndexByte(l.line, '\n')
+		if i < 0 {
+			return
+		}
+		l.log(string(l.line[:i]))
+		l.line = l.line[i+1:]
+	}
+}
+
+func (l *stderrLogger) flush() {
+	if len(l.line) > 0 {
+		l.log(string(l.line))
+		l.line = nil
+	}
+}
+
+func (l *stderrLogger) log(line string) {
+	line = strings.TrimRight(line, "\r")
+	if l.t.Logger == nil || line == "" {
+		return
+	}
+	if l.t.Name != "" {
+		l.t.Logger.Warnf("fastcgi %s: %s", l.t.Name, line)
+		return
+	}
+	l.t.Logger.Warnf("fastcgi: %s", line)
+}
@@ -0,0 +1,31 @@
+package fastcgi
+
+import "testing"
+
+func TestScript(t *testing.T) {
+	tr := &Transport{Root: "/srv/www", SplitPath: []string{".php"}, Index: "index.php"}
+	for _, tc := range []struct {
+		path, scriptName, pathInfo string
+	}{
+		{"/index.php", "/index.php", ""},
+		{"/index.php/users/1", "/index.php", "/users/1"},
+		{"/INDEX.PHP/users", "/INDEX.PHP", "/users"},
+		{"/a.php.d/b.php", "/a.php.d/b.php", ""},
+		{"/a.php.d/b.php/info", "/a.php.d/b.php", "/info"},
+		{"/a.phpx/b.php/c.php", "/a.phpx/b.php", "/c.php"},
+		{"/docs/", "/docs/index.php", ""},
+		{"/static/app.js", "/static/app.js", ""},
+		{"/../etc/passwd.php", "/etc/passwd.php", ""},
+	} {
+		env := map[string]string{"PATH_INFO": tc.path}
+		if err := tr.script(env); err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		if env["SCRIPT_NAME"] != tc.scriptName || env["PATH_INFO"] != tc.pathInfo {
+			t.Errorf("%s split into %q %q, want %q %q", tc.path, env["SCRIPT_NAME"], env["PATH_INFO"], tc.scriptName, tc.pathInfo)
+		}
+		if want := "/srv/www" + tc.scriptName; env["SCRIPT_FILENAME"] != want {
+			t.Errorf("%s SCRIPT_FILENAME %q, want %q", tc.path, env["SCRIPT_FILENAME"], want)
+		}
+	}
+}
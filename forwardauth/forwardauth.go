@@ -0,0 +1,149 @@
+package forwardauth
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Config defines the config for ForwardAuth middleware.
+//
+// For every request the middleware sends a GET subrequest, without a body, to
+// URL carrying the original request headers plus X-Original-Method,
+// X-Original-URI and X-Forwarded-{For,Host,Proto}. A 2xx answer lets the
+// request through, a 401 or 403 answer is relayed to the client as is and any
+// other answer, or none, is a 502 Bad Gateway. What went wrong is kept in the
+// error for the log, clients are not told where the service is.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// URL of the authorization service.
+	// Required.
+	URL string
+
+	// ResponseHeaders are copied from a successful auth response onto the
+	// request sent upstream, e.g. X-User. They are always removed from the
+	// incoming request first so clients cannot inject them.
+	ResponseHeaders []string
+
+	// Timeout for the subrequest.
+	// default 5 seconds
+	Timeout time.Duration
+
+	// Client used to send subrequests.
+	// default a client with Timeout that does not follow redirects
+	Client *http.Client
+}
+
+// DefaultConfig is the default ForwardAuth middleware config
+var DefaultConfig = Config{
+	Skipper: middleware.DefaultSkipper,
+	Timeout: 5 * time.Second,
+}
+
+// hopHeaders are not forwarded to the authorization service.
+var hopHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Middleware returns a ForwardAuth middleware asking url to authorize requests.
+func Middleware(url string) echo.MiddlewareFunc {
+	c := DefaultConfig
+	c.URL = url
+	return MiddlewareWithConfig(c)
+}
+
+// MiddlewareWithConfig returns a ForwardAuth middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.URL == "" {
+		panic("forwardauth: middleware requires an auth url")
+	}
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultConfig.Timeout
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{
+			Timeout: config.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			for _, h := range config.ResponseHeaders {
+				req.Header.Del(h)
+			}
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			sub, err := http.NewRequestWithContext(req.Context(), http.MethodGet, config.URL, nil)
+			if err != nil {
+				return err
+			}
+			for k, v := range req.Header {
+				sub.Header[k] = v
+			}
+			for _, h := range hopHeaders {
+				sub.Header.Del(h)
+			}
+			sub.Header.Set("X-Original-Method", req.Method)
+			sub.Header.Set("X-Original-URI", req.RequestURI)
+			sub.Header.Set(echo.HeaderXForwardedFor, c.RealIP())
+			sub.Header.Set(echo.HeaderXForwardedProto, c.Scheme())
+			sub.Header.Set("X-Forwarded-Host", req.Host)
+
+			res, err := config.Client.Do(sub)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadGateway).SetInternal(
+					fmt.Errorf("auth service %s unreachable: %v", config.URL, err))
+			}
+			defer res.Body.Close()
+
+			switch {
+			case res.StatusCode >= 200 && res.StatusCode < 300:
+				for _, h := range config.ResponseHeaders {
+					if v := res.Header.Values(h); len(v) > 0 {
+						req.Header[http.CanonicalHeaderKey(h)] = v
+					}
+				}
+				return next(c)
+			case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+				header := c.Response().Header()
+				for k, v := range res.Header {
+					header[k] = v
+				}
+				for _, h := range hopHeaders {
+					header.Del(h)
+				}
+				c.Response().WriteHeader(res.StatusCode)
+				_, err = io.Copy(c.Response(), res.Body)
+				return err
+			default:
+				return echo.NewHTTPError(http.StatusBadGateway).SetInternal(
+					fmt.Errorf("auth service %s returned unexpected status %d", config.URL, res.StatusCode))
+			}
+		}
+	}
+}
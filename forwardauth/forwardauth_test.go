@@ -0,0 +1,94 @@
+package forwardauth
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestServer returns a server authorizing its requests with the service at
+// url and answering with the X-User it is given.
+func newTestServer(url string) *echo.Echo {
+	e := echo.New()
+	e.Use(MiddlewareWithConfig(Config{URL: url, ResponseHeaders: []string{"X-User"}}))
+	e.GET("/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, "hello "+c.Request().Header.Get("X-User"))
+	})
+	return e
+}
+
+func serve(e *echo.Echo, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAllow(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			t.Errorf("Authorization %q not forwarded", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("X-Original-Method") != http.MethodGet || r.Header.Get("X-Original-URI") != "/a?b=c" {
+			t.Errorf("original request %s %s", r.Header.Get("X-Original-Method"), r.Header.Get("X-Original-URI"))
+		}
+		if r.Header.Get("X-User") != "" {
+			t.Errorf("client X-User %q reached the auth service", r.Header.Get("X-User"))
+		}
+		w.Header().Set("X-User", "alice")
+		w.Header().Set("X-Other", "dropped")
+	}))
+	defer auth.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/a?b=c", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	req.Header.Set("X-User", "mallory")
+	rec := serve(newTestServer(auth.URL), req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello alice" {
+		t.Fatalf("got %d %q, want %d \"hello alice\"", rec.Code, rec.Body.String(), http.StatusOK)
+	}
+}
+
+func TestDeny(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="moxie"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("login first"))
+	}))
+	defer auth.Close()
+
+	rec := serve(newTestServer(auth.URL), httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusUnauthorized || rec.Body.String() != "login first" {
+		t.Fatalf("got %d %q, want %d \"login first\"", rec.Code, rec.Body.String(), http.StatusUnauthorized)
+	}
+	if rec.Header().Get("WWW-Authenticate") != `Bearer realm="moxie"` {
+		t.Fatalf("WWW-Authenticate %q not relayed", rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestUnexpectedStatus(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer auth.Close()
+
+	rec := serve(newTestServer(auth.URL), httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway || strings.Contains(rec.Body.String(), auth.URL) {
+		t.Fatalf("got %d %q, want %d without the auth url", rec.Code, rec.Body.String(), http.StatusBadGateway)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	auth := httptest.NewServer(http.NotFoundHandler())
+	url := auth.URL + "/auth"
+	auth.Close()
+
+	rec := serve(newTestServer(url), httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("got %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if body := rec.Body.String(); strings.Contains(body, url) || strings.Contains(body, "refused") {
+		t.Fatalf("response %q leaks the auth service", body)
+	}
+}
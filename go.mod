@@ -1,11 +1,32 @@
 module github.com/allnash/moxie
 
-go 1.16
+go 1.26.0
 
 require (
-	github.com/BurntSushi/toml v1.3.2 // indirect
-	github.com/ilyakaznacheev/cleanenv v1.5.0 // indirect
-	github.com/jpillora/ipfilter v1.2.8
+	github.com/andybalholm/brotli v1.2.1
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/ilyakaznacheev/cleanenv v1.5.0
+	github.com/klauspost/compress v1.18.5
 	github.com/labstack/echo/v4 v4.5.0
+	github.com/labstack/gommon v0.3.0
+	github.com/quic-go/quic-go v0.63.0
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.56.0
+	golang.org/x/sync v0.22.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
+
+require (
+	github.com/BurntSushi/toml v1.3.2 // indirect
+	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/mattn/go-colorable v0.1.8 // indirect
+	github.com/mattn/go-isatty v0.0.12 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/fasttemplate v1.2.1 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+	olympos.io/encoding/edn v0.0.0-20201019073823-d3554ca0b0a3 // indirect
+)
@@ -0,0 +1,371 @@
+package grpcproxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config defines the config for GRPCProxy middleware.
+//
+// The middleware prepares gRPC requests for the proxy middleware that
+// follows it. Errors of the chain, e.g. a failed authentication or an
+// unreachable upstream, and non-gRPC error responses of the upstream are
+// turned into a grpc-status, so clients get a gRPC error rather than an
+// HTTP one. gRPC-Web requests from browsers are translated into gRPC
+// requests, the upstream's response trailers are sent back as the final
+// gRPC-Web frame.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// Web translates gRPC-Web requests, application/grpc-web and
+	// application/grpc-web-text, otherwise they are proxied as they are.
+	// default false
+	Web bool
+}
+
+// DefaultConfig is the default GRPCProxy middleware config
+var DefaultConfig = Config{
+	Skipper: middleware.DefaultSkipper,
+}
+
+// Middleware returns a GRPCProxy middleware translating gRPC-Web requests.
+func Middleware() echo.MiddlewareFunc {
+	c := DefaultConfig
+	c.Web = true
+	return MiddlewareWithConfig(c)
+}
+
+// MiddlewareWithConfig returns a GRPCProxy middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) {
+				return next(c)
+			}
+			req := c.Request()
+			kind := requestKind(req)
+			if kind == notGRPC || kind != native && !config.Web {
+				return next(c)
+			}
+
+			w := &responseWriter{ResponseWriter: c.Response().Writer, kind: kind}
+			c.Response().Writer = w
+			if kind != native {
+				translateRequest(req, kind)
+			}
+			err := next(c)
+			w.finish(err)
+			return nil
+		}
+	}
+}
+
+type kind int
+
+const (
+	notGRPC kind = iota
+	native
+	web
+	webText
+)
+
+const (
+	grpcContentType    = "application/grpc"
+	webContentType     = "application/grpc-web"
+	webTextContentType = "application/grpc-web-text"
+)
+
+// requestKind tells gRPC and gRPC-Web requests apart by content type, e.g.
+// application/grpc+proto or application/grpc-web-text.
+func requestKind(req *http.Request) kind {
+	if req.Method != http.MethodPost {
+		return notGRPC
+	}
+	ct := req.Header.Get(echo.HeaderContentType)
+	switch {
+	case hasType(ct, webTextContentType):
+		return webText
+	case hasType(ct, webContentType):
+		return web
+	case hasType(ct, grpcContentType):
+		return native
+	}
+	return notGRPC
+}
+
+// hasType reports whether ct is base, optionally followed by a +format
+// suffix or parameters.
+func hasType(ct, base string) bool {
+	if !strings.HasPrefix(ct, base) {
+		return false
+	}
+	rest := ct[len(base):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// translateRequest turns a gRPC-Web request into a gRPC request.
+func translateRequest(req *http.Request, k kind) {
+	ct := req.Header.Get(echo.HeaderContentType)
+	if k == webText {
+		ct = grpcContentType + ct[len(webTextContentType):]
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{&textReader{r: req.Body}, req.Body}
+		req.ContentLength = -1
+		req.Header.Del(echo.HeaderContentLength)
+	} else {
+		ct = grpcContentType + ct[len(webContentType):]
+	}
+	req.Header.Set(echo.HeaderContentType, ct)
+	req.Header.Set("Te", "trailers")
+	req.Header.Del("X-Grpc-Web")
+}
+
+// responseWriter rewrites the upstream response for gRPC clients.
+type responseWriter struct {
+	http.ResponseWriter
+	kind        kind
+	wroteHeader bool
+	replaced    bool     // an error response replaced the upstream's
+	trailers    []string // trailer names announced by the upstream
+	pending     []byte   // less than 3 bytes of grpc-web-text not encoded yet
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if h.Get("Grpc-Status") == "" && (code != http.StatusOK || !hasType(h.Get(echo.HeaderContentType), grpcContentType)) {
+		// Not a gRPC response, e.g. an error page of a load balancer.
+		w.replaced = true
+		w.writeStatus(fromHTTP(code), fmt.Sprintf("upstream responded with HTTP %d %s", code, http.StatusText(code)))
+		return
+	}
+	if w.kind != native {
+		// Trailers are sent as the last frame of the body.
+		w.trailers = h.Values("Trailer")
+		h.Del("Trailer")
+		h.Del(echo.HeaderContentLength)
+		h.Set(echo.HeaderContentType, w.contentType(h.Get(echo.HeaderContentType)))
+	}
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(p), nil
+	}
+	if w.kind == webText {
+		// Whole groups of 3 bytes are encoded without padding, the body
+		// is one base64 stream however the upstream's writes are cut.
+		data := append(w.pending, p...)
+		n := len(data) / 3 * 3
+		if _, err := io.WriteString(w.ResponseWriter, base64.StdEncoding.EncodeToString(data[:n])); err != nil {
+			return 0, err
+		}
+		w.pending = append(w.pending[:0:0], data[n:]...)
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush lets the proxy stream responses.
+func (w *responseWriter) Flush() {
+	w.flushText()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// flushText sends the bytes held back from grpc-web-text, padded. Clients
+// decode padding as the end of a chunk, a streamed message is not kept
+// waiting for the next one.
+func (w *responseWriter) flushText() {
+	if len(w.pending) > 0 && !w.replaced {
+		io.WriteString(w.ResponseWriter, base64.StdEncoding.EncodeToString(w.pending))
+		w.pending = nil
+	}
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeStatus sends a trailers-only response, the status in the headers.
+func (w *responseWriter) writeStatus(code int, message string) {
+	h := w.Header()
+	for name := range h {
+		delete(h, name)
+	}
+	ct := grpcContentType
+	if w.kind != native {
+		ct = w.contentType(ct)
+	}
+	h.Set(echo.HeaderContentType, ct)
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", encodeMessage(message))
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+// finish reports err, the error of the chain, if the upstream gave no
+// status, and sends the trailers of a gRPC-Web response.
+func (w *responseWriter) finish(err error) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.replaced = true
+		code, message := codeUnknown, "no response"
+		if err != nil {
+			code, message = fromError(err)
+		}
+		w.writeStatus(code, message)
+		return
+	}
+	if w.replaced {
+		return
+	}
+
+	h := w.Header()
+	if w.kind == native {
+		if err != nil && h.Get("Grpc-Status") == "" && h.Get(http.TrailerPrefix+"Grpc-Status") == "" {
+			// The stream broke after the response started.
+			code, message := fromError(err)
+			h.Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+			h.Set(http.TrailerPrefix+"Grpc-Message", encodeMessage(message))
+		}
+		return
+	}
+
+	// The proxy sets announced trailers as headers and the others with
+	// http.TrailerPrefix, they are moved into the trailer frame.
+	trailers := http.Header{}
+	for _, names := range w.trailers {
+		for _, name := range strings.Split(names, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := h[name]; ok {
+				trailers[name] = values
+				delete(h, name)
+			}
+		}
+	}
+	for name, values := range h {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(name[len(http.TrailerPrefix):])] = values
+			delete(h, name)
+		}
+	}
+	if err != nil && h.Get("Grpc-Status") == "" && trailers.Get("Grpc-Status") == "" {
+		code, message := fromError(err)
+		trailers.Set("Grpc-Status", strconv.Itoa(code))
+		trailers.Set("Grpc-Message", encodeMessage(message))
+	}
+	if len(trailers) > 0 {
+		w.writeTrailers(trailers)
+	}
+	w.flushText()
+}
+
+// writeTrailers sends trailers as a gRPC-Web trailer frame, flagged 0x80,
+// holding them as lower case HTTP/1.1 header lines.
+func (w *responseWriter) writeTrailers(trailers http.Header) {
+	names := make([]string, 0, len(trailers))
+	for name := range trailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var block strings.Builder
+	for _, name := range names {
+		for _, value := range trailers[name] {
+			block.WriteString(strings.ToLower(name) + ": " + value + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	frame = append(frame, block.String()...)
+	w.Write(frame)
+}
+
+// contentType returns the gRPC-Web type for the gRPC type ct.
+func (w *responseWriter) contentType(ct string) string {
+	if !hasType(ct, grpcContentType) {
+		ct = grpcContentType
+	}
+	if w.kind == webText {
+		return webTextContentType + ct[len(grpcContentType):]
+	}
+	return webContentType + ct[len(grpcContentType):]
+}
+
+// gRPC status codes.
+const (
+	codeCanceled         = 1
+	codeUnknown          = 2
+	codePermissionDenied = 7
+	codeUnimplemented    = 12
+	codeInternal         = 13
+	codeUnavailable      = 14
+	codeUnauthenticated  = 16
+)
+
+// fromHTTP maps an HTTP status to a gRPC status like gRPC clients do when
+// a response lacks grpc-status.
+func fromHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return codeInternal
+	case http.StatusUnauthorized:
+		return codeUnauthenticated
+	case http.StatusForbidden:
+		return codePermissionDenied
+	case http.StatusNotFound:
+		return codeUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codeUnavailable
+	case middleware.StatusCodeContextCanceled:
+		return codeCanceled
+	}
+	return codeUnknown
+}
+
+// fromError maps an error of the chain to a gRPC status and message.
+func fromError(err error) (int, string) {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return fromHTTP(he.Code), fmt.Sprint(he.Message)
+	}
+	return codeUnknown, err.Error()
+}
+
+// encodeMessage percent-encodes a grpc-message value.
+func encodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
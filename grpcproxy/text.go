@@ -0,0 +1,68 @@
+package grpcproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+)
+
+// textReader decodes an application/grpc-web-text request body. Clients
+// encode each message on its own, so the body may be padded base64 chunks
+// one after another, which a single base64 stream decoder rejects. Every
+// 4 characters decode on their own, padding ends a chunk wherever it is.
+type textReader struct {
+	r    io.Reader
+	in   []byte // base64 not decoded yet, less than 4 characters between reads
+	out  []byte // decoded, not read yet
+	err  error
+	read [4096]byte
+}
+
+func (t *textReader) Read(p []byte) (int, error) {
+	for len(t.out) == 0 {
+		if t.err != nil {
+			if t.err == io.EOF && len(t.in) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, t.err
+		}
+		var n int
+		n, t.err = t.r.Read(t.read[:])
+		for _, c := range t.read[:n] {
+			if c != '\r' && c != '\n' {
+				t.in = append(t.in, c)
+			}
+		}
+		complete := len(t.in) / 4 * 4
+		out, err := decodeChunks(t.in[:complete])
+		if err != nil {
+			t.err = err
+			return 0, err
+		}
+		t.out = out
+		t.in = append(t.in[:0], t.in[complete:]...)
+	}
+	n := copy(p, t.out)
+	t.out = t.out[n:]
+	return n, nil
+}
+
+// decodeChunks decodes src, whole groups of 4 characters, which may hold
+// padded chunks one after another.
+func decodeChunks(src []byte) ([]byte, error) {
+	dst := make([]byte, len(src)/4*3)
+	n := 0
+	for len(src) > 0 {
+		end := len(src)
+		if i := bytes.IndexByte(src, '='); i >= 0 {
+			end = (i/4 + 1) * 4
+		}
+		m, err := base64.StdEncoding.Decode(dst[n:], src[:end])
+		if err != nil {
+			return nil, err
+		}
+		n += m
+		src = src[end:]
+	}
+	return dst[:n], nil
+}
@@ -0,0 +1,123 @@
+package httpsredirect
+
+import (
+	"github.com/allnash/moxie/ipfilter"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Config defines the config for HTTPSRedirect middleware.
+//
+// Plain HTTP requests are redirected to the same host, path and query on the
+// HTTPS listener. GET and HEAD requests get a 301, other methods a 308 so
+// clients repeat them with the same method and body.
+//
+// A request is secure when it came over TLS. X-Forwarded-Proto and the like
+// are believed only from TrustedProxies, anyone else could send them to be
+// served over plain HTTP.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// Port of the HTTPS listener, left out of the redirect when it is 443.
+	// default "443"
+	Port string
+
+	// ExemptPaths are path prefixes still served over plain HTTP. They match
+	// whole segments of the cleaned request path.
+	// default the ACME HTTP-01 challenge path "/.well-known/acme-challenge/"
+	ExemptPaths []string
+
+	// TrustedProxies are IPs or CIDRs of proxies terminating TLS in front,
+	// whose forwarded scheme headers are believed.
+	// Optional.
+	TrustedProxies []string
+}
+
+// DefaultConfig is the default HTTPSRedirect middleware config
+var DefaultConfig = Config{
+	Skipper:     middleware.DefaultSkipper,
+	Port:        "443",
+	ExemptPaths: []string{"/.well-known/acme-challenge/"},
+}
+
+// Middleware returns an HTTPSRedirect middleware redirecting to port.
+func Middleware(port string) echo.MiddlewareFunc {
+	c := DefaultConfig
+	c.Port = port
+	return MiddlewareWithConfig(c)
+}
+
+// MiddlewareWithConfig returns an HTTPSRedirect middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+	if config.Port == "" {
+		config.Port = DefaultConfig.Port
+	}
+	if config.ExemptPaths == nil {
+		config.ExemptPaths = DefaultConfig.ExemptPaths
+	}
+	trusted, err := ipfilter.New(config.TrustedProxies, nil, true)
+	if err != nil {
+		panic("echo: https redirect trusted proxies: " + err.Error())
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if config.Skipper(c) || req.TLS != nil {
+				return next(c)
+			}
+			if len(config.TrustedProxies) > 0 && c.Scheme() == "https" {
+				ip := req.RemoteAddr
+				if host, _, err := net.SplitHostPort(ip); err == nil {
+					ip = host
+				}
+				if trusted.AllowedString(ip) {
+					return next(c)
+				}
+			}
+			if exempt(req.URL.Path, config.ExemptPaths) {
+				return next(c)
+			}
+
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]" // IPv6 literal
+			}
+			if config.Port != "443" {
+				host += ":" + config.Port
+			}
+			code := http.StatusMovedPermanently
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				code = http.StatusPermanentRedirect
+			}
+			return c.Redirect(code, "https://"+host+req.URL.RequestURI())
+		}
+	}
+}
+
+// exempt reports whether p, once cleaned, is one of prefixes or below it, so
+// dot segments cannot walk out of an exempt path.
+func exempt(p string, prefixes []string) bool {
+	p = path.Clean("/" + p)
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
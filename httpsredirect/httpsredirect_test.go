@@ -0,0 +1,34 @@
+package httpsredirect
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExemptPaths(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware("443"))
+	e.GET("/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, "plain")
+	})
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/.well-known/acme-challenge/token", http.StatusOK},
+		{"/.well-known/acme-challenge", http.StatusOK},
+		{"/.well-known/acme-challenge/../admin", http.StatusMovedPermanently},
+		{"/.well-known/acme-challenge/%2e%2e/admin", http.StatusMovedPermanently},
+		{"/.well-known/acme-challenge-other", http.StatusMovedPermanently},
+		{"/admin", http.StatusMovedPermanently},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+tc.path, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s got %d, want %d", tc.path, rec.Code, tc.code)
+		}
+	}
+}
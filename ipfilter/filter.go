@@ -0,0 +1,133 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Filter decides whether an IP address may pass. It holds exact IPv4 and IPv6
+// addresses in a set and CIDR ranges in one radix trie per address family.
+//
+// Precedence, from highest to lowest:
+//   - an exact IP entry
+//   - the longest (most specific) CIDR containing the address
+//   - the default (BlockByDefault)
+//
+// If the same IP or CIDR is both allowed and blocked, the block wins.
+//
+// IPv4 addresses are also IPv4-mapped IPv6 ones (::ffff:a.b.c.d), so IPv6
+// ranges covering ::ffff:0:0/96, such as ::/0, hold every IPv4 address. They
+// apply when no IPv4 range does.
+//
+// A Filter is not safe for concurrent modification; build it fully before
+// calling Allowed from multiple goroutines.
+type Filter struct {
+	ips            map[[16]byte]action
+	v4             trie
+	v6             trie
+	blockByDefault bool
+}
+
+// New returns a Filter built from the given allow and block lists. Entries may
+// be single IPv4/IPv6 addresses or CIDRs.
+func New(allowed, blocked []string, blockByDefault bool) (*Filter, error) {
+	f := &Filter{
+		ips:            map[[16]byte]action{},
+		blockByDefault: blockByDefault,
+	}
+	for _, entry := range allowed {
+		if err := f.Allow(entry); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range blocked {
+		if err := f.Block(entry); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Allow adds an IP or CIDR to the allow list.
+func (f *Filter) Allow(entry string) error {
+	return f.add(entry, allow)
+}
+
+// Block adds an IP or CIDR to the block list.
+func (f *Filter) Block(entry string) error {
+	return f.add(entry, deny)
+}
+
+// Len returns the number of distinct IPs and CIDRs held by the filter.
+func (f *Filter) Len() int {
+	return len(f.ips) + f.v4.size + f.v6.size
+}
+
+func (f *Filter) add(entry string, rule action) error {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return fmt.Errorf("ipfilter: invalid IP %q", entry)
+		}
+		var key [16]byte
+		copy(key[:], ip.To16())
+		f.ips[key] = f.ips[key].merge(rule)
+		return nil
+	}
+	_, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return fmt.Errorf("ipfilter: invalid CIDR %q", entry)
+	}
+	bits, size := ipnet.Mask.Size()
+	ip4 := ipnet.IP.To4()
+	if ip4 != nil && size == 128 {
+		// IPv4-mapped IPv6 range, e.g. ::ffff:10.0.0.0/104
+		if bits < 96 {
+			f.v6.insert(ipnet.IP.To16(), bits, rule)
+			return nil
+		}
+		bits -= 96
+	}
+	if ip4 != nil {
+		f.v4.insert(ip4, bits, rule)
+	} else {
+		f.v6.insert(ipnet.IP.To16(), bits, rule)
+	}
+	return nil
+}
+
+// Allowed reports whether ip may pass through the filter. A nil ip is never
+// allowed.
+func (f *Filter) Allowed(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	var key [16]byte
+	copy(key[:], ip16)
+	rule, ok := f.ips[key]
+	if !ok || rule == none {
+		if ip4 := ip.To4(); ip4 != nil {
+			rule = f.v4.lookup(ip4)
+			if rule == none {
+				rule = f.v6.lookup(ip16)
+			}
+		} else {
+			rule = f.v6.lookup(ip16)
+		}
+	}
+	switch rule {
+	case allow:
+		return true
+	case deny:
+		return false
+	}
+	return !f.blockByDefault
+}
+
+// AllowedString is Allowed for a textual IP address.
+func (f *Filter) AllowedString(ip string) bool {
+	return f.Allowed(net.ParseIP(ip))
+}
@@ -0,0 +1,114 @@
+package ipfilter
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		allowed        []string
+		blocked        []string
+		blockByDefault bool
+		ip             string
+		want           bool
+	}{
+		{"default allow", nil, nil, false, "10.0.0.1", true},
+		{"default block", nil, nil, true, "10.0.0.1", false},
+		{"cidr over default", []string{"10.0.0.0/8"}, nil, true, "10.1.2.3", true},
+		{"outside cidr", []string{"10.0.0.0/8"}, nil, true, "11.1.2.3", false},
+		{"longest cidr allows", []string{"10.1.0.0/16"}, []string{"10.0.0.0/8"}, false, "10.1.2.3", true},
+		{"longest cidr blocks", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, true, "10.1.2.3", false},
+		{"shorter cidr past longest", []string{"10.1.0.0/16"}, []string{"10.0.0.0/8"}, false, "10.2.0.1", false},
+		{"exact ip over cidr", []string{"10.1.2.3"}, []string{"10.0.0.0/8"}, false, "10.1.2.3", true},
+		{"exact ip block over cidr", []string{"10.0.0.0/8"}, []string{"10.1.2.3"}, true, "10.1.2.3", false},
+		{"exact ip over /32", []string{"10.1.2.3"}, []string{"10.1.2.3/32"}, false, "10.1.2.3", true},
+		{"/32 over shorter cidr", []string{"10.1.2.3/32"}, []string{"10.0.0.0/8"}, false, "10.1.2.3", true},
+		{"deny wins ip tie", []string{"10.1.2.3"}, []string{"10.1.2.3"}, false, "10.1.2.3", false},
+		{"deny wins cidr tie", []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, false, "10.1.2.3", false},
+		{"ipv6 cidr", []string{"2001:db8::/32"}, nil, true, "2001:db8::1", true},
+		{"ipv6 longest cidr", []string{"2001:db8::/32"}, []string{"2001:db8:1::/48"}, false, "2001:db8:1::1", false},
+		{"ipv6 exact ip", []string{"2001:db8::1"}, []string{"2001:db8::/32"}, false, "2001:db8::1", true},
+		{"ipv6 rule not ipv4", []string{"2001:db8::/32"}, nil, true, "10.0.0.1", false},
+		{"ipv4 rule not ipv6", []string{"10.0.0.0/8"}, nil, true, "2001:db8::1", false},
+		{"mapped client, ipv4 cidr", []string{"10.0.0.0/8"}, nil, true, "::ffff:10.1.2.3", true},
+		{"mapped client, ipv4 ip", nil, []string{"10.1.2.3"}, false, "::ffff:10.1.2.3", false},
+		{"mapped cidr, ipv4 client", []string{"::ffff:10.0.0.0/104"}, nil, true, "10.1.2.3", true},
+		{"mapped ip, ipv4 client", nil, []string{"::ffff:10.1.2.3"}, false, "10.1.2.3", false},
+		{"::/0 holds ipv4", []string{"::/0"}, nil, true, "10.1.2.3", true},
+		{"ipv4 cidr over ::/0", []string{"::/0"}, []string{"10.0.0.0/8"}, false, "10.1.2.3", false},
+		{"invalid ip", nil, nil, false, "not an ip", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := New(tc.allowed, tc.blocked, tc.blockByDefault)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.AllowedString(tc.ip); got != tc.want {
+				t.Fatalf("Allowed(%s) = %v, want %v", tc.ip, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, entry := range []string{"10.0.0", "10.0.0.0/33", "2001:db8::/129", "example.com"} {
+		if _, err := New([]string{entry}, nil, false); err == nil {
+			t.Errorf("New accepted %q", entry)
+		}
+	}
+}
+
+// BenchmarkAllowed looks up addresses in filters of 1k to 1M IPv4 /24 and
+// IPv6 /48 prefixes, half of them inside one.
+func BenchmarkAllowed(b *testing.B) {
+	for _, family := range []struct {
+		name   string
+		size   int // address length in bytes
+		prefix int // prefix length in bytes
+	}{
+		{"ipv4", net.IPv4len, 3},
+		{"ipv6", net.IPv6len, 6},
+	} {
+		for _, n := range []int{1000, 100000, 1000000} {
+			b.Run(fmt.Sprintf("%s/%d", family.name, n), func(b *testing.B) {
+				r := rand.New(rand.NewSource(1))
+				random := func() net.IP {
+					ip := make(net.IP, family.size)
+					r.Read(ip)
+					if family.size == net.IPv6len {
+						ip[0] = 0x20 // global unicast, not IPv4-mapped
+					}
+					return ip
+				}
+				f, err := New(nil, nil, true)
+				if err != nil {
+					b.Fatal(err)
+				}
+				prefixes := make([]net.IP, n)
+				for i := range prefixes {
+					prefixes[i] = random()
+					ipnet := net.IPNet{IP: prefixes[i], Mask: net.CIDRMask(family.prefix*8, family.size*8)}
+					if err := f.Allow(ipnet.String()); err != nil {
+						b.Fatal(err)
+					}
+				}
+				ips := make([]net.IP, 1024)
+				for i := range ips {
+					ips[i] = random()
+					if i%2 == 0 {
+						copy(ips[i], prefixes[r.Intn(n)][:family.prefix])
+					}
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					f.Allowed(ips[i%len(ips)])
+				}
+			})
+		}
+	}
+}
@@ -2,7 +2,6 @@ package ipfilter
 
 import (
 	"fmt"
-	"github.com/jpillora/ipfilter"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"net"
@@ -18,14 +17,20 @@ type Config struct {
 	// default middleware.DefaultSkipper
 	Skipper middleware.Skipper
 
-	// WhiteList is an allowed ip list.
+	// WhiteList is an allowed ip list. Entries are IPv4/IPv6 addresses or CIDRs.
 	WhiteList []string
 
-	// BlackList is a disallowed ip list.
+	// BlackList is a disallowed ip list. Entries are IPv4/IPv6 addresses or CIDRs.
+	// See Filter for how it takes precedence over WhiteList.
 	BlackList []string
 
 	// Block by default.
 	BlockByDefault bool
+
+	// Filter, when set, is used instead of one built from WhiteList,
+	// BlackList and BlockByDefault, e.g. to report bad entries with New.
+	// Optional.
+	Filter *Filter
 }
 
 // DefaultConfig is the default IPFilter middleware config
@@ -43,20 +48,19 @@ func Middleware() echo.MiddlewareFunc {
 // MiddlewareWithConfig returns an IPFilter middleware with config.
 // See: `IPFilter()`.
 func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
-	var err error
-
 	// Defaults
 	if config.Skipper == nil {
 		config.Skipper = DefaultConfig.Skipper
 	}
 
-	// New jpillora/ipfilter instance
-	filter := ipfilter.New(ipfilter.Options{
-		AllowedIPs:     config.WhiteList,
-		BlockedIPs:     config.BlackList,
-		BlockByDefault: config.BlockByDefault,
-		Logger:         nil,
-	})
+	filter := config.Filter
+	if filter == nil {
+		var err error
+		filter, err = New(config.WhiteList, config.BlackList, config.BlockByDefault)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -65,12 +69,18 @@ func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
 			}
 			ip := c.RealIP()
 			if ip == "" {
+				if _, ok := c.Request().Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+					// A Unix socket peer without a forwarded address,
+					// access to the socket is up to its permissions.
+					return next(c)
+				}
+				var err error
 				ip, _, err = net.SplitHostPort(c.Request().RemoteAddr)
 				if err != nil {
 					return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 				}
 			}
-			if !filter.Allowed(ip) {
+			if !filter.AllowedString(ip) {
 				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("IP address %s not allowed", ip))
 			}
 			return next(c)
@@ -0,0 +1,149 @@
+package ipfilter
+
+// action is the rule stored against a prefix in the trie.
+type action uint8
+
+const (
+	none action = iota
+	allow
+	deny
+)
+
+// merge combines two rules set on the same prefix; deny always wins a tie.
+func (a action) merge(b action) action {
+	if a == deny || b == deny {
+		return deny
+	}
+	if a == allow || b == allow {
+		return allow
+	}
+	return none
+}
+
+// node is a path-compressed (patricia) trie node. key holds the prefix with
+// all bits past bits masked to zero.
+type node struct {
+	key   []byte
+	bits  int
+	rule  action
+	child [2]*node
+}
+
+// trie is a binary radix trie keyed by fixed-size addresses (4 bytes for
+// IPv4, 16 bytes for IPv6). Lookups visit at most one node per distinct
+// branching point, so cost is bounded by the address width and independent of
+// the number of prefixes stored.
+type trie struct {
+	root *node
+	size int
+}
+
+// insert stores rule against the prefix key/bits.
+func (t *trie) insert(key []byte, bits int, rule action) {
+	key = maskKey(key, bits)
+	p := &t.root
+	for {
+		n := *p
+		if n == nil {
+			*p = &node{key: key, bits: bits, rule: rule}
+			t.size++
+			return
+		}
+		common := commonBits(n.key, key, minInt(n.bits, bits))
+		switch {
+		case common == n.bits && common == bits:
+			if n.rule == none {
+				t.size++
+			}
+			n.rule = n.rule.merge(rule)
+			return
+		case common == n.bits:
+			// n is a prefix of key, descend
+			p = &n.child[bitAt(key, n.bits)]
+		case common == bits:
+			// key is a prefix of n, insert above it
+			leaf := &node{key: key, bits: bits, rule: rule}
+			leaf.child[bitAt(n.key, bits)] = n
+			*p = leaf
+			t.size++
+			return
+		default:
+			// key and n diverge, insert a branching node
+			branch := &node{key: maskKey(key, common), bits: common}
+			leaf := &node{key: key, bits: bits, rule: rule}
+			branch.child[bitAt(key, common)] = leaf
+			branch.child[bitAt(n.key, common)] = n
+			*p = branch
+			t.size++
+			return
+		}
+	}
+}
+
+// lookup returns the rule of the longest prefix containing key.
+func (t *trie) lookup(key []byte) action {
+	best := none
+	width := len(key) * 8
+	for n := t.root; n != nil; {
+		if commonBits(n.key, key, n.bits) != n.bits {
+			break
+		}
+		if n.rule != none {
+			best = n.rule
+		}
+		if n.bits >= width {
+			break
+		}
+		n = n.child[bitAt(key, n.bits)]
+	}
+	return best
+}
+
+// bitAt returns bit i of key, counting from the most significant bit.
+func bitAt(key []byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+// commonBits returns how many leading bits a and b share, up to max.
+func commonBits(a, b []byte, max int) int {
+	n := 0
+	for i := 0; n < max; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			x <<= 1
+			n++
+		}
+		break
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+// maskKey returns a copy of key with every bit past bits cleared.
+func maskKey(key []byte, bits int) []byte {
+	out := make([]byte, len(key))
+	copy(out, key)
+	for i := range out {
+		switch {
+		case bits >= (i+1)*8:
+		case bits <= i*8:
+			out[i] = 0
+		default:
+			out[i] &= ^byte(0xff >> uint(bits-i*8))
+		}
+	}
+	return out
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
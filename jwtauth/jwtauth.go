@@ -0,0 +1,91 @@
+package jwtauth
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+	"strings"
+)
+
+// Config defines the config for JWT middleware.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// Verifier validates bearer tokens.
+	// Required.
+	Verifier *Verifier
+
+	// ClaimsHeaders maps claim names to request headers set on the request
+	// sent upstream, e.g. "sub": "X-User". The headers are always removed
+	// from the incoming request first so clients cannot inject them.
+	ClaimsHeaders map[string]string
+
+	// Realm is sent in the WWW-Authenticate challenge.
+	// default "Restricted"
+	Realm string
+}
+
+// DefaultConfig is the default JWT middleware config
+var DefaultConfig = Config{
+	Skipper: middleware.DefaultSkipper,
+	Realm:   "Restricted",
+}
+
+// Middleware returns a JWT middleware validating bearer tokens with verifier.
+func Middleware(verifier *Verifier) echo.MiddlewareFunc {
+	c := DefaultConfig
+	c.Verifier = verifier
+	return MiddlewareWithConfig(c)
+}
+
+// MiddlewareWithConfig returns a JWT middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Verifier == nil || config.Verifier.Keys == nil {
+		panic("jwtauth: middleware requires a verifier with keys")
+	}
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+	if config.Realm == "" {
+		config.Realm = DefaultConfig.Realm
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			for _, h := range config.ClaimsHeaders {
+				req.Header.Del(h)
+			}
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			auth := req.Header.Get(echo.HeaderAuthorization)
+			if len(auth) <= len("bearer ") || !strings.EqualFold(auth[:len("bearer ")], "bearer ") {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, fmt.Sprintf("Bearer realm=%q", config.Realm))
+				return echo.NewHTTPError(http.StatusUnauthorized, "missing bearer token")
+			}
+			claims, err := config.Verifier.Verify(strings.TrimSpace(auth[len("bearer "):]))
+			if err != nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate,
+					fmt.Sprintf("Bearer realm=%q, error=\"invalid_token\"", config.Realm))
+				httpError := echo.NewHTTPError(http.StatusUnauthorized, "invalid bearer token")
+				httpError.Internal = err
+				return httpError
+			}
+
+			for claim, h := range config.ClaimsHeaders {
+				if v, ok := claims[claim]; ok {
+					req.Header.Set(h, ClaimString(v))
+				}
+			}
+			c.Set("jwt_claims", claims)
+			return next(c)
+		}
+	}
+}
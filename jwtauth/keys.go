@@ -0,0 +1,287 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrKeyNotFound is returned when no key matches a token's kid.
+var ErrKeyNotFound = errors.New("jwtauth: signing key not found")
+
+// KeySet holds the verification keys of a JSON Web Key Set loaded from a URL
+// or a local file. Remote sets are refreshed every RefreshInterval and, when a
+// token names an unknown kid, at most once per MinRefreshInterval so a key
+// rotation is picked up without hammering the provider. Requests arriving
+// while keys are fetched wait for that fetch rather than start their own.
+// Local files are re-read when they change.
+type KeySet struct {
+	// RefreshInterval is how long fetched keys are trusted.
+	// default 1 hour
+	RefreshInterval time.Duration
+
+	// MinRefreshInterval limits refetches triggered by unknown kids.
+	// default 1 minute
+	MinRefreshInterval time.Duration
+
+	url     string
+	file    string
+	client  *http.Client
+	group   singleflight.Group
+	mu      sync.RWMutex
+	keys    map[string]interface{}
+	fetched time.Time
+	modTime time.Time
+}
+
+// NewRemoteKeySet returns a KeySet fetching keys from a JWKS url. Keys are
+// fetched lazily on first use.
+func NewRemoteKeySet(url string) *KeySet {
+	return &KeySet{
+		RefreshInterval:    time.Hour,
+		MinRefreshInterval: time.Minute,
+		url:                url,
+		client:             &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewFileKeySet returns a KeySet reading keys from a local JWKS file.
+func NewFileKeySet(file string) (*KeySet, error) {
+	ks := &KeySet{file: file}
+	if err := ks.reloadFile(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// NewStaticKeySet returns a KeySet holding a fixed set of keys, e.g. an HMAC
+// secret under kid "". A key under kid "" matches tokens naming any kid that
+// is not in keys, since a shared secret has no key ID to check.
+func NewStaticKeySet(keys map[string]interface{}) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+// Key returns the key with the given kid. An empty kid matches the only key
+// of a single key set, and any kid matches the "" key of a static set.
+func (ks *KeySet) Key(kid string) (interface{}, error) {
+	switch {
+	case ks.file != "":
+		// Keep the last good keys if the file is briefly unreadable.
+		_ = ks.reloadFile()
+	case ks.url != "":
+		ks.mu.RLock()
+		stale := time.Since(ks.fetched) > ks.RefreshInterval
+		ks.mu.RUnlock()
+		if stale {
+			if err := ks.refresh(); err != nil && ks.empty() {
+				return nil, err
+			}
+		}
+	}
+
+	if key := ks.lookup(kid); key != nil {
+		return key, nil
+	}
+	if ks.url != "" {
+		ks.mu.RLock()
+		recent := time.Since(ks.fetched) < ks.MinRefreshInterval
+		ks.mu.RUnlock()
+		if !recent {
+			if err := ks.refresh(); err != nil {
+				return nil, err
+			}
+			if key := ks.lookup(kid); key != nil {
+				return key, nil
+			}
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (ks *KeySet) lookup(kid string) interface{} {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if key, ok := ks.keys[kid]; ok {
+		return key
+	}
+	if key, ok := ks.keys[""]; ok && ks.url == "" && ks.file == "" {
+		return key
+	}
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+func (ks *KeySet) empty() bool {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return len(ks.keys) == 0
+}
+
+// refresh fetches the keys, or waits for the fetch under way.
+func (ks *KeySet) refresh() error {
+	_, err, _ := ks.group.Do(ks.url, func() (interface{}, error) {
+		return nil, ks.fetch()
+	})
+	return err
+}
+
+func (ks *KeySet) fetch() error {
+	// Record the attempt, failed too, so a failing provider is not retried
+	// on every request. Until then requests join this fetch.
+	defer func() {
+		ks.mu.Lock()
+		ks.fetched = time.Now()
+		ks.mu.Unlock()
+	}()
+
+	res, err := ks.client.Get(ks.url)
+	if err != nil {
+		return fmt.Errorf("jwtauth: fetching %s: %v", ks.url, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwtauth: fetching %s: status %d", ks.url, res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(body)
+	if err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+	return nil
+}
+
+func (ks *KeySet) reloadFile() error {
+	info, err := os.Stat(ks.file)
+	if err != nil {
+		return err
+	}
+	ks.mu.RLock()
+	unchanged := ks.keys != nil && info.ModTime().Equal(ks.modTime)
+	ks.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	body, err := ioutil.ReadFile(ks.file)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(body)
+	if err != nil {
+		return fmt.Errorf("%v in %s", err, ks.file)
+	}
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.modTime = info.ModTime()
+	ks.mu.Unlock()
+	return nil
+}
+
+// jwk is a single JSON Web Key (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// ParseJWKS parses a JSON Web Key Set into keys indexed by kid. RSA keys
+// become *rsa.PublicKey, EC keys *ecdsa.PublicKey and symmetric keys []byte.
+// Keys meant for encryption and unknown key types are skipped.
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwtauth: invalid JWKS: %v", err)
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwtauth: key %q: %v", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
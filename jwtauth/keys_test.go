@@ -0,0 +1,102 @@
+package jwtauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves a JWKS of one HMAC key, named kid, and counts its
+// requests.
+type jwksServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	kid      string
+	key      []byte
+	requests int32
+	delay    time.Duration
+}
+
+func newJWKSServer(t *testing.T, kid string, key []byte) *jwksServer {
+	s := &jwksServer{kid: kid, key: key}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		time.Sleep(s.delay)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "oct",
+			"kid": s.kid,
+			"k":   base64.RawURLEncoding.EncodeToString(s.key),
+		}}})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) rotate(kid string, key []byte) {
+	s.mu.Lock()
+	s.kid, s.key = kid, key
+	s.mu.Unlock()
+}
+
+func signKid(t *testing.T, kid string, key []byte) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, newKey := []byte("old key of 32 bytes, for HS256!!"), []byte("new key of 32 bytes, for HS256!!")
+	s := newJWKSServer(t, "old", oldKey)
+	ks := NewRemoteKeySet(s.URL)
+	v := &Verifier{Keys: ks}
+
+	if _, err := v.Verify(signKid(t, "old", oldKey)); err != nil {
+		t.Fatalf("old key: %v", err)
+	}
+	s.rotate("new", newKey)
+	if _, err := v.Verify(signKid(t, "new", newKey)); err == nil || !strings.Contains(err.Error(), ErrKeyNotFound.Error()) {
+		t.Fatalf("new key within MinRefreshInterval got %v, want it not found yet", err)
+	}
+
+	ks.MinRefreshInterval = 0
+	if _, err := v.Verify(signKid(t, "new", newKey)); err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	if _, err := v.Verify(signKid(t, "old", oldKey)); err == nil {
+		t.Fatal("old key still accepted after rotation")
+	}
+}
+
+func TestConcurrentFetch(t *testing.T) {
+	s := newJWKSServer(t, "k", secret)
+	s.delay = 100 * time.Millisecond
+	ks := NewRemoteKeySet(s.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ks.Key("k"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&s.requests); n != 1 {
+		t.Fatalf("%d fetches of stale keys, want 1", n)
+	}
+}
@@ -0,0 +1,176 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verifier checks a token's signature against a KeySet and validates its
+// exp, nbf, iss and aud claims.
+type Verifier struct {
+	// Keys used to verify signatures.
+	// Required.
+	Keys *KeySet
+
+	// Algorithms accepted in the token header.
+	// default HS256, RS256 and ES256
+	Algorithms []string
+
+	// Issuer, when set, must equal the iss claim.
+	Issuer string
+
+	// Audience, when set, must contain one of the aud claim values.
+	Audience []string
+
+	// Leeway allowed for clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// DefaultAlgorithms are accepted when Verifier.Algorithms is empty.
+var DefaultAlgorithms = []string{"HS256", "RS256", "ES256"}
+
+// Verify parses and validates token, returning its claims.
+func (v *Verifier) Verify(token string) (jwt.MapClaims, error) {
+	algorithms := v.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = DefaultAlgorithms
+	}
+	parser := &jwt.Parser{ValidMethods: algorithms, SkipClaimsValidation: true}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := v.Keys.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		// Refuse keys of the wrong type, e.g. an RSA public key used as an
+		// HMAC secret.
+		ok := false
+		switch t.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			_, ok = key.([]byte)
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			_, ok = key.(*rsa.PublicKey)
+		case *jwt.SigningMethodECDSA:
+			_, ok = key.(*ecdsa.PublicKey)
+		}
+		if !ok {
+			return nil, fmt.Errorf("jwtauth: key %q cannot verify %s", kid, t.Method.Alg())
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) validate(claims jwt.MapClaims) error {
+	now := time.Now()
+	exp, ok, err := numericClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if ok && now.After(exp.Add(v.Leeway)) {
+		return errors.New("jwtauth: token is expired")
+	}
+	nbf, ok, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(v.Leeway).Before(nbf) {
+		return errors.New("jwtauth: token is not valid yet")
+	}
+	if v.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.Issuer {
+			return fmt.Errorf("jwtauth: unexpected issuer %q", iss)
+		}
+	}
+	if len(v.Audience) > 0 {
+		found := false
+		for _, aud := range StringsClaim(claims, "aud") {
+			for _, want := range v.Audience {
+				if aud == want {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return errors.New("jwtauth: token audience not accepted")
+		}
+	}
+	return nil
+}
+
+// numericClaim returns the time of a NumericDate claim, ok is false when it
+// is missing. A claim of another type is an error rather than missing, a
+// token must not escape expiry with "exp": "never".
+func numericClaim(claims jwt.MapClaims, name string) (t time.Time, ok bool, err error) {
+	value, present := claims[name]
+	if !present {
+		return time.Time{}, false, nil
+	}
+	var f float64
+	switch v := value.(type) {
+	case float64:
+		f = v
+	case json.Number:
+		if f, err = v.Float64(); err != nil {
+			return time.Time{}, false, fmt.Errorf("jwtauth: %s claim is not a number", name)
+		}
+	default:
+		return time.Time{}, false, fmt.Errorf("jwtauth: %s claim is not a number", name)
+	}
+	return time.Unix(int64(f), 0), true, nil
+}
+
+// StringsClaim returns a claim that may be a single string or a list of
+// strings, e.g. aud or groups.
+func StringsClaim(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// ClaimString renders a claim as a header value. Lists are joined with
+// commas and objects are JSON encoded.
+func ClaimString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool, json.Number:
+		return fmt.Sprint(v)
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, ClaimString(item))
+		}
+		return strings.Join(parts, ",")
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
@@ -0,0 +1,84 @@
+package jwtauth
+
+import (
+	"github.com/golang-jwt/jwt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+func sign(t *testing.T, key []byte, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	v := &Verifier{
+		Keys:     NewStaticKeySet(map[string]interface{}{"": secret}),
+		Issuer:   "https://issuer.example.com",
+		Audience: []string{"moxie"},
+	}
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "https://issuer.example.com",
+			"aud": []string{"other", "moxie"},
+			"exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(-time.Minute).Unix(),
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		edit  func(jwt.MapClaims)
+		key   []byte
+		error string // empty when the token is valid
+	}{
+		{"valid", func(jwt.MapClaims) {}, secret, ""},
+		{"no exp or nbf", func(c jwt.MapClaims) { delete(c, "exp"); delete(c, "nbf") }, secret, ""},
+		{"signature", func(jwt.MapClaims) {}, []byte("another secret of enough length!"), "signature is invalid"},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Minute).Unix() }, secret, "expired"},
+		{"not yet valid", func(c jwt.MapClaims) { c["nbf"] = now.Add(time.Minute).Unix() }, secret, "not valid yet"},
+		{"exp not a number", func(c jwt.MapClaims) { c["exp"] = "never" }, secret, "exp claim is not a number"},
+		{"nbf not a number", func(c jwt.MapClaims) { c["nbf"] = true }, secret, "nbf claim is not a number"},
+		{"issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, secret, "unexpected issuer"},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "other" }, secret, "audience not accepted"},
+		{"no audience", func(c jwt.MapClaims) { delete(c, "aud") }, secret, "audience not accepted"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := valid()
+			tc.edit(claims)
+			_, err := v.Verify(sign(t, tc.key, claims))
+			switch {
+			case tc.error == "" && err != nil:
+				t.Fatalf("got %v, want a valid token", err)
+			case tc.error != "" && (err == nil || !strings.Contains(err.Error(), tc.error)):
+				t.Fatalf("got %v, want an error containing %q", err, tc.error)
+			}
+		})
+	}
+}
+
+func TestVerifySecretIgnoresKid(t *testing.T) {
+	v := &Verifier{Keys: NewStaticKeySet(map[string]interface{}{"": secret})}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{})
+	token.Header["kid"] = "2024-01"
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(signed); err != nil {
+		t.Fatalf("token with a kid got %v, want the shared secret used", err)
+	}
+}
+
+func TestVerifyAlgorithms(t *testing.T) {
+	v := &Verifier{Keys: NewStaticKeySet(map[string]interface{}{"": secret}), Algorithms: []string{"RS256"}}
+	if _, err := v.Verify(sign(t, secret, jwt.MapClaims{})); err == nil {
+		t.Fatal("HS256 token accepted when only RS256 is")
+	}
+}
@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metric families and renders them in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// Default is the registry served by Handler.
+var Default = &Registry{}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+func (r *Registry) register(name, help, kind string, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, values: map[string]*sample{}}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+func (f *family) add(delta float64, set bool, labels []string) {
+	if len(labels) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d labels, got %d", f.name, len(f.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	f.mu.Lock()
+	s, ok := f.values[key]
+	if !ok {
+		s = &sample{labels: append([]string(nil), labels...)}
+		f.values[key] = s
+	}
+	if set {
+		s.value = delta
+	} else {
+		s.value += delta
+	}
+	f.mu.Unlock()
+}
+
+func (f *family) delete(labels []string) {
+	f.mu.Lock()
+	delete(f.values, strings.Join(labels, "\xff"))
+	f.mu.Unlock()
+}
+
+// Gauge is a value that can go up and down, partitioned by labels.
+type Gauge struct {
+	f *family
+}
+
+// NewGauge registers a gauge with the Default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{f: Default.register(name, help, "gauge", labels)}
+}
+
+// Set sets the gauge for the given label values.
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.f.add(value, true, labels)
+}
+
+// Add adds delta, which may be negative, to the gauge.
+func (g *Gauge) Add(delta float64, labels ...string) {
+	g.f.add(delta, false, labels)
+}
+
+// Delete removes the series for the given label values.
+func (g *Gauge) Delete(labels ...string) {
+	g.f.delete(labels)
+}
+
+// Counter is a value that only goes up, partitioned by labels.
+type Counter struct {
+	f *family
+}
+
+// NewCounter registers a counter with the Default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{f: Default.register(name, help, "counter", labels)}
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc(labels ...string) {
+	c.f.add(1, false, labels)
+}
+
+// Add adds a non-negative delta to the counter.
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.f.add(delta, false, labels)
+}
+
+// Write renders all families to w.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, f := range families {
+		f.mu.Lock()
+		samples := make([]*sample, 0, len(f.values))
+		for _, s := range f.values {
+			samples = append(samples, s)
+		}
+		f.mu.Unlock()
+		sort.Slice(samples, func(i, j int) bool {
+			return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+		})
+
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range samples {
+			b.WriteString(f.name)
+			if len(f.labels) > 0 {
+				b.WriteByte('{')
+				for i, name := range f.labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", name, escape(s.labels[i]))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(formatValue(s.value))
+			b.WriteByte('\n')
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Handler serves the Default registry.
+func Handler(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	return Default.Write(c.Response())
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
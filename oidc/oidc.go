@@ -0,0 +1,420 @@
+package oidc
+
+import (
+	"fmt"
+	"github.com/allnash/moxie/jwtauth"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config defines the config for the OpenID Connect login middleware.
+//
+// Unauthenticated browser requests are redirected to the issuer using the
+// authorization code flow. After the callback the user's claims are kept in an
+// encrypted session cookie which is refreshed with the refresh token, when the
+// issuer provides one, once the ID token expires.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// Issuer URL, used for discovery and checked against the iss claim.
+	// Required.
+	Issuer string
+
+	// ClientID and ClientSecret registered with the issuer.
+	// Required.
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL registered with the issuer. Its path is served by the
+	// middleware.
+	// default "<scheme>://<host>/oauth2/callback" of the incoming request
+	RedirectURL string
+
+	// Scopes requested.
+	// default ["openid", "email", "profile"]
+	Scopes []string
+
+	// CookieName of the session cookie.
+	// default "moxie_session"
+	CookieName string
+
+	// CookieSecret encrypts the session cookie; at least 16 characters.
+	// Required.
+	CookieSecret string
+
+	// AllowedDomains, when set, restricts access to users whose email
+	// address is in one of these domains and has email_verified true.
+	AllowedDomains []string
+
+	// AllowedGroups, when set, restricts access to members of one of these
+	// groups.
+	AllowedGroups []string
+
+	// GroupsClaim names the claim holding the user's groups.
+	// default "groups"
+	GroupsClaim string
+
+	// ClaimsHeaders maps claim names to request headers set on the request
+	// sent upstream, e.g. "email": "X-Email". The headers are always removed
+	// from the incoming request first so clients cannot inject them.
+	ClaimsHeaders map[string]string
+
+	// Client used to talk to the issuer.
+	// default a client with a 10 second timeout
+	Client *http.Client
+}
+
+// DefaultConfig is the default OIDC middleware config
+var DefaultConfig = Config{
+	Skipper:     middleware.DefaultSkipper,
+	Scopes:      []string{"openid", "email", "profile"},
+	CookieName:  "moxie_session",
+	GroupsClaim: "groups",
+}
+
+const (
+	// CallbackPath is served when RedirectURL is not set.
+	CallbackPath = "/oauth2/callback"
+
+	// LogoutPath clears the session cookie.
+	LogoutPath = "/oauth2/sign_out"
+
+	stateTTL = 10 * time.Minute
+)
+
+// MiddlewareWithConfig returns an OIDC login middleware with config.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Issuer == "" || config.ClientID == "" {
+		panic("oidc: middleware requires an issuer and a client id")
+	}
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = DefaultConfig.Scopes
+	}
+	if config.CookieName == "" {
+		config.CookieName = DefaultConfig.CookieName
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = DefaultConfig.GroupsClaim
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	callbackPath := CallbackPath
+	if config.RedirectURL != "" {
+		u, err := url.Parse(config.RedirectURL)
+		if err != nil {
+			panic(err)
+		}
+		callbackPath = u.Path
+	}
+	sealer, err := newSealer(config.CookieSecret)
+	if err != nil {
+		panic(err)
+	}
+
+	g := &gateway{
+		config:       config,
+		callbackPath: callbackPath,
+		sealer:       sealer,
+		provider:     &provider{issuer: config.Issuer, client: config.Client},
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			for _, h := range config.ClaimsHeaders {
+				req.Header.Del(h)
+			}
+			switch req.URL.Path {
+			case callbackPath:
+				return g.callback(c)
+			case LogoutPath:
+				g.setCookie(c, config.CookieName, "", -1)
+				return c.Redirect(http.StatusFound, "/")
+			}
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			sess := g.session(c)
+			if sess != nil && sess.expired() {
+				sess = g.refresh(c, sess)
+			}
+			if sess == nil {
+				return g.login(c)
+			}
+			if !g.allowed(sess.Claims) {
+				return echo.NewHTTPError(http.StatusForbidden, "user not allowed")
+			}
+			for claim, h := range config.ClaimsHeaders {
+				if v, ok := sess.Claims[claim]; ok {
+					req.Header.Set(h, jwtauth.ClaimString(v))
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+type gateway struct {
+	config       Config
+	callbackPath string
+	sealer       *sealer
+	provider     *provider
+}
+
+func (g *gateway) stateCookie() string {
+	return g.config.CookieName + "_state"
+}
+
+func (g *gateway) redirectURL(c echo.Context) string {
+	if g.config.RedirectURL != "" {
+		return g.config.RedirectURL
+	}
+	return c.Scheme() + "://" + c.Request().Host + CallbackPath
+}
+
+// login starts the authorization code flow for browser navigations and
+// rejects everything else.
+func (g *gateway) login(c echo.Context) error {
+	req := c.Request()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return echo.NewHTTPError(http.StatusUnauthorized, "login required")
+	}
+	if err := g.provider.discover(); err != nil {
+		return g.unavailable(err)
+	}
+	state := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Redirect: req.URL.RequestURI(),
+		Expiry:   time.Now().Add(stateTTL).Unix(),
+	}
+	value, err := g.sealer.seal(g.stateCookie(), state)
+	if err != nil {
+		return err
+	}
+	g.setCookie(c, g.stateCookie(), value, int(stateTTL/time.Second))
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", g.config.ClientID)
+	q.Set("redirect_uri", g.redirectURL(c))
+	q.Set("scope", strings.Join(g.config.Scopes, " "))
+	q.Set("state", state.State)
+	q.Set("nonce", state.Nonce)
+	sep := "?"
+	if strings.Contains(g.provider.authEndpoint, "?") {
+		sep = "&"
+	}
+	return c.Redirect(http.StatusFound, g.provider.authEndpoint+sep+q.Encode())
+}
+
+// callback completes the flow: it checks state, redeems the code, verifies
+// the ID token and stores the session.
+func (g *gateway) callback(c echo.Context) error {
+	if e := c.QueryParam("error"); e != "" {
+		return echo.NewHTTPError(http.StatusForbidden, "login failed: "+e+" "+c.QueryParam("error_description"))
+	}
+	cookie, err := c.Cookie(g.stateCookie())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "login state missing")
+	}
+	g.setCookie(c, g.stateCookie(), "", -1)
+	var state loginState
+	if err := g.sealer.open(g.stateCookie(), cookie.Value, &state); err != nil || time.Now().Unix() > state.Expiry {
+		return echo.NewHTTPError(http.StatusBadRequest, "login state invalid or expired")
+	}
+	if c.QueryParam("state") != state.State {
+		return echo.NewHTTPError(http.StatusBadRequest, "login state mismatch")
+	}
+	if err := g.provider.discover(); err != nil {
+		return g.unavailable(err)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", c.QueryParam("code"))
+	form.Set("redirect_uri", g.redirectURL(c))
+	tr, err := g.provider.token(g.config.ClientID, g.config.ClientSecret, form)
+	if err != nil {
+		return g.unavailable(err)
+	}
+	if tr.IDToken == "" {
+		return g.unavailable(fmt.Errorf("oidc: token response has no id_token"))
+	}
+	claims, err := g.verify(tr.IDToken)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid id token").SetInternal(err)
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != state.Nonce {
+		return echo.NewHTTPError(http.StatusUnauthorized, "id token nonce mismatch")
+	}
+	sess := g.newSession(claims, tr)
+	if sess.subject() == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "id token has no subject")
+	}
+	if !g.allowed(sess.Claims) {
+		return echo.NewHTTPError(http.StatusForbidden, "user not allowed")
+	}
+	if err := g.store(c, sess); err != nil {
+		return err
+	}
+
+	redirect := state.Redirect
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	return c.Redirect(http.StatusFound, redirect)
+}
+
+// refresh renews an expired session with its refresh token, returning nil
+// when that is not possible.
+func (g *gateway) refresh(c echo.Context, sess *session) *session {
+	if sess.RefreshToken == "" || g.provider.discover() != nil {
+		return nil
+	}
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", sess.RefreshToken)
+	tr, err := g.provider.token(g.config.ClientID, g.config.ClientSecret, form)
+	if err != nil {
+		c.Logger().Warn(err)
+		return nil
+	}
+	claims := jwt.MapClaims(sess.Claims)
+	if tr.IDToken != "" {
+		if claims, err = g.verify(tr.IDToken); err != nil {
+			c.Logger().Warn(err)
+			return nil
+		}
+	}
+	fresh := g.newSession(claims, tr)
+	if fresh.subject() != sess.subject() {
+		c.Logger().Warnf("oidc: refreshed id token subject %q does not match session %q", fresh.subject(), sess.subject())
+		return nil
+	}
+	if fresh.RefreshToken == "" {
+		fresh.RefreshToken = sess.RefreshToken
+	}
+	if err := g.store(c, fresh); err != nil {
+		return nil
+	}
+	return fresh
+}
+
+func (g *gateway) verify(idToken string) (jwt.MapClaims, error) {
+	v := &jwtauth.Verifier{
+		Keys:       g.provider.keys,
+		Algorithms: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256"},
+		Issuer:     g.config.Issuer,
+		Audience:   []string{g.config.ClientID},
+		Leeway:     time.Minute,
+	}
+	return v.Verify(idToken)
+}
+
+// newSession keeps the claims needed for authorization and headers.
+func (g *gateway) newSession(claims jwt.MapClaims, tr *tokenResponse) *session {
+	keep := map[string]interface{}{}
+	for _, name := range []string{"sub", "email", "email_verified", g.config.GroupsClaim} {
+		if v, ok := claims[name]; ok {
+			keep[name] = v
+		}
+	}
+	for name := range g.config.ClaimsHeaders {
+		if v, ok := claims[name]; ok {
+			keep[name] = v
+		}
+	}
+	expiry := time.Now().Add(time.Hour).Unix()
+	if exp, ok := claims["exp"].(float64); ok && tr.IDToken != "" {
+		expiry = int64(exp)
+	} else if tr.ExpiresIn > 0 {
+		expiry = time.Now().Unix() + tr.ExpiresIn
+	}
+	return &session{Claims: keep, Expiry: expiry, RefreshToken: tr.RefreshToken}
+}
+
+func (g *gateway) session(c echo.Context) *session {
+	cookie, err := c.Cookie(g.config.CookieName)
+	if err != nil {
+		return nil
+	}
+	var sess session
+	if err := g.sealer.open(g.config.CookieName, cookie.Value, &sess); err != nil || sess.subject() == "" {
+		return nil
+	}
+	return &sess
+}
+
+func (g *gateway) store(c echo.Context, sess *session) error {
+	value, err := g.sealer.seal(g.config.CookieName, sess)
+	if err != nil {
+		return err
+	}
+	g.setCookie(c, g.config.CookieName, value, 0)
+	return nil
+}
+
+func (g *gateway) allowed(claims map[string]interface{}) bool {
+	if len(g.config.AllowedDomains) > 0 {
+		email, _ := claims["email"].(string)
+		// Providers that leave out email_verified are not trusted with it
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return false
+		}
+		at := strings.LastIndexByte(email, '@')
+		if at < 0 || !containsFold(g.config.AllowedDomains, email[at+1:]) {
+			return false
+		}
+	}
+	if len(g.config.AllowedGroups) > 0 {
+		member := false
+		for _, group := range jwtauth.StringsClaim(claims, g.config.GroupsClaim) {
+			if containsFold(g.config.AllowedGroups, group) {
+				member = true
+			}
+		}
+		if !member {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *gateway) setCookie(c echo.Context, name, value string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (g *gateway) unavailable(err error) error {
+	return echo.NewHTTPError(http.StatusBadGateway, "identity provider unavailable").SetInternal(err)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
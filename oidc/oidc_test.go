@@ -0,0 +1,207 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mockProvider is an issuer serving discovery, its keys and a token endpoint
+// answering with an ID token for claims.
+type mockProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, p.claims)
+		token.Header["kid"] = "test"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id_token": signed, "expires_in": 3600})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func newTestServer(issuer string) *echo.Echo {
+	e := echo.New()
+	e.Use(MiddlewareWithConfig(Config{
+		Issuer:        issuer,
+		ClientID:      "moxie",
+		ClientSecret:  "secret",
+		CookieSecret:  "0123456789abcdef",
+		ClaimsHeaders: map[string]string{"sub": "X-User"},
+	}))
+	e.GET("/app", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Request().Header.Get("X-User"))
+	})
+	return e
+}
+
+func serve(e *echo.Echo, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func cookie(t *testing.T, rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name && c.Value != "" {
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie set", name)
+	return nil
+}
+
+// login runs the flow up to the callback, returning the callback response
+// and the state cookie.
+func login(t *testing.T, e *echo.Echo, p *mockProvider, claims jwt.MapClaims) (*httptest.ResponseRecorder, *http.Cookie) {
+	rec := serve(e, "/app")
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status %d, want %d", rec.Code, http.StatusFound)
+	}
+	state := cookie(t, rec, "moxie_session_state")
+	u, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.claims = jwt.MapClaims{
+		"iss":   p.URL,
+		"aud":   "moxie",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": u.Query().Get("nonce"),
+	}
+	for name, v := range claims {
+		p.claims[name] = v
+	}
+	callback := serve(e, CallbackPath+"?code=c&state="+url.QueryEscape(u.Query().Get("state")), state)
+	return callback, state
+}
+
+func TestLogin(t *testing.T) {
+	p := newMockProvider(t)
+	e := newTestServer(p.URL)
+
+	rec, _ := login(t, e, p, jwt.MapClaims{"sub": "alice"})
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/app" {
+		t.Fatalf("callback status %d to %q, want %d to /app", rec.Code, rec.Header().Get("Location"), http.StatusFound)
+	}
+	rec = serve(e, "/app", cookie(t, rec, "moxie_session"))
+	if rec.Code != http.StatusOK || rec.Body.String() != "alice" {
+		t.Fatalf("got %d %q, want %d \"alice\"", rec.Code, rec.Body.String(), http.StatusOK)
+	}
+}
+
+func TestStateReplayedAsSession(t *testing.T) {
+	p := newMockProvider(t)
+	e := newTestServer(p.URL)
+
+	rec := serve(e, "/app")
+	state := cookie(t, rec, "moxie_session_state")
+	rec = serve(e, "/app", &http.Cookie{Name: "moxie_session", Value: state.Value})
+	if rec.Code != http.StatusFound {
+		t.Fatalf("state cookie as session got %d, want a %d to login", rec.Code, http.StatusFound)
+	}
+}
+
+func TestSessionReplayedAsState(t *testing.T) {
+	p := newMockProvider(t)
+	e := newTestServer(p.URL)
+
+	rec, _ := login(t, e, p, jwt.MapClaims{"sub": "alice"})
+	session := cookie(t, rec, "moxie_session")
+	rec = serve(e, CallbackPath+"?code=c&state=s", &http.Cookie{Name: "moxie_session_state", Value: session.Value})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("session cookie as state got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestNoSubject(t *testing.T) {
+	p := newMockProvider(t)
+	e := newTestServer(p.URL)
+
+	rec, _ := login(t, e, p, nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("id token without sub got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	// A session sealed without one, as older versions could, is not one.
+	s, err := newSealer("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := s.seal("moxie_session", &session{
+		Claims: map[string]interface{}{"email": "alice@example.com"},
+		Expiry: time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = serve(e, "/app", &http.Cookie{Name: "moxie_session", Value: value})
+	if rec.Code != http.StatusFound {
+		t.Fatalf("session without sub got %d, want a %d to login", rec.Code, http.StatusFound)
+	}
+}
+
+func TestAllowedDomains(t *testing.T) {
+	g := &gateway{config: Config{AllowedDomains: []string{"example.com"}}}
+	for _, tc := range []struct {
+		claims  map[string]interface{}
+		allowed bool
+	}{
+		{map[string]interface{}{"email": "alice@example.com", "email_verified": true}, true},
+		{map[string]interface{}{"email": "alice@EXAMPLE.com", "email_verified": true}, true},
+		{map[string]interface{}{"email": "alice@example.com", "email_verified": false}, false},
+		{map[string]interface{}{"email": "alice@example.com"}, false},
+		{map[string]interface{}{"email": "alice@example.com", "email_verified": "true"}, false},
+		{map[string]interface{}{"email": "alice@example.org", "email_verified": true}, false},
+		{map[string]interface{}{"email_verified": true}, false},
+	} {
+		if got := g.allowed(tc.claims); got != tc.allowed {
+			t.Errorf("allowed(%v) = %v, want %v", tc.claims, got, tc.allowed)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/allnash/moxie/jwtauth"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// provider holds an issuer's discovered endpoints. Discovery happens lazily
+// and is retried on failure, so moxie starts even when the issuer is down.
+type provider struct {
+	issuer string
+	client *http.Client
+
+	mu            sync.Mutex
+	authEndpoint  string
+	tokenEndpoint string
+	keys          *jwtauth.KeySet
+	lastAttempt   time.Time
+}
+
+// tokenResponse is the token endpoint reply (RFC 6749 section 5.1).
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+func (p *provider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tokenEndpoint != "" {
+		return nil
+	}
+	if time.Since(p.lastAttempt) < 5*time.Second {
+		return fmt.Errorf("oidc: discovery for %s failed recently", p.issuer)
+	}
+	p.lastAttempt = time.Now()
+
+	res, err := p.client.Get(strings.TrimSuffix(p.issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("oidc: discovery for %s: %v", p.issuer, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: discovery for %s: status %d", p.issuer, res.StatusCode)
+	}
+	var doc struct {
+		Issuer        string `json:"issuer"`
+		AuthEndpoint  string `json:"authorization_endpoint"`
+		TokenEndpoint string `json:"token_endpoint"`
+		JWKSURI       string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("oidc: discovery for %s: %v", p.issuer, err)
+	}
+	if doc.Issuer != p.issuer {
+		return fmt.Errorf("oidc: issuer %q does not match configured %q", doc.Issuer, p.issuer)
+	}
+	if doc.AuthEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return fmt.Errorf("oidc: discovery for %s is missing endpoints", p.issuer)
+	}
+	p.authEndpoint = doc.AuthEndpoint
+	p.tokenEndpoint = doc.TokenEndpoint
+	p.keys = jwtauth.NewRemoteKeySet(doc.JWKSURI)
+	return nil
+}
+
+// token posts form to the token endpoint authenticating with the client
+// credentials (client_secret_basic).
+func (p *provider) token(clientID, clientSecret string, form url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request: %v", err)
+	}
+	defer res.Body.Close()
+	var tr tokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("oidc: token response: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("oidc: token request failed: status %d %s %s", res.StatusCode, tr.Error, tr.Description)
+	}
+	return &tr, nil
+}
@@ -0,0 +1,98 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// session is what the encrypted session cookie carries.
+type session struct {
+	Claims       map[string]interface{} `json:"c"`
+	Expiry       int64                  `json:"e"`
+	RefreshToken string                 `json:"r,omitempty"`
+}
+
+// subject returns the sub claim identifying the user, empty when missing.
+func (s *session) subject() string {
+	sub, _ := s.Claims["sub"].(string)
+	return sub
+}
+
+func (s *session) expired() bool {
+	return time.Now().Unix() >= s.Expiry
+}
+
+// loginState is kept in a short lived cookie between the redirect to the
+// provider and the callback.
+type loginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Redirect string `json:"u"`
+	Expiry   int64  `json:"e"`
+}
+
+// sealer encrypts and authenticates cookie values with AES-256-GCM. Each
+// value is bound to the name of its cookie as additional data, so one cookie
+// cannot be replayed as another, e.g. the login state as a session.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(secret string) (*sealer, error) {
+	if len(secret) < 16 {
+		return nil, errors.New("oidc: cookie secret must be at least 16 characters")
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+func (s *sealer) seal(name string, v interface{}) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plain, []byte(name))), nil
+}
+
+func (s *sealer) open(name, value string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	if len(data) < s.aead.NonceSize() {
+		return errors.New("oidc: cookie too short")
+	}
+	nonce, data := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, data, []byte(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config defines the config for Proxy middleware.
+//
+// Requests are forwarded with httputil.ReverseProxy. Connection upgrades,
+// such as WebSockets, go through the same Transport as other requests, so
+// upstream TLS settings apply to them as well, and the upgraded connection
+// is subject to the WebSocket limits below.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// Balancer selects the upstream target of each request.
+	// Required.
+	Balancer middleware.ProxyBalancer
+
+	// ContextKey stores the selected target in the context.
+	// default "target"
+	ContextKey string
+
+	// Transport used to reach the upstream.
+	// default http.DefaultTransport
+	Transport http.RoundTripper
+
+	// ModifyResponse is called with every upstream response.
+	// Optional.
+	ModifyResponse func(*http.Response) error
+
+	// FlushInterval is how often buffered response bytes are flushed to the
+	// client, a negative value flushes after every write. Server-Sent Events
+	// (text/event-stream) and responses of unknown length are always flushed
+	// immediately.
+	// default 0, responses are buffered
+	FlushInterval time.Duration
+
+	// FlushIntervals overrides FlushInterval for path prefixes, the longest
+	// matching prefix wins.
+	// Optional.
+	FlushIntervals map[string]time.Duration
+
+	// Name identifies the proxied service in metrics.
+	// Optional.
+	Name string
+
+	// WebSocketIdleTimeout closes an upgraded connection when no data flowed
+	// in either direction for this long.
+	// default 0, no idle timeout
+	WebSocketIdleTimeout time.Duration
+
+	// WebSocketMaxLifetime closes an upgraded connection this long after the
+	// upgrade, whatever its activity.
+	// default 0, no limit
+	WebSocketMaxLifetime time.Duration
+
+	// MaxWebSockets caps the concurrent upgraded connections, further
+	// upgrade requests get a 503.
+	// default 0, no limit
+	MaxWebSockets int
+}
+
+// DefaultConfig is the default Proxy middleware config
+var DefaultConfig = Config{
+	Skipper:    middleware.DefaultSkipper,
+	ContextKey: "target",
+}
+
+// Middleware returns a Proxy middleware forwarding to the balancer's targets.
+func Middleware(balancer middleware.ProxyBalancer) echo.MiddlewareFunc {
+	c := DefaultConfig
+	c.Balancer = balancer
+	return MiddlewareWithConfig(c)
+}
+
+// MiddlewareWithConfig returns a Proxy middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+	if config.Balancer == nil {
+		panic("proxy: middleware requires a balancer")
+	}
+	if config.ContextKey == "" {
+		config.ContextKey = DefaultConfig.ContextKey
+	}
+	var upgrades int64
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			req := c.Request()
+			upgrade := isUpgrade(req)
+			if upgrade {
+				switch {
+				case connections.isDraining():
+					rejectedTotal.Inc(config.Name, "shutdown")
+					return echo.NewHTTPError(http.StatusServiceUnavailable, "server is shutting down")
+				case config.MaxWebSockets > 0 && atomic.AddInt64(&upgrades, 1) > int64(config.MaxWebSockets):
+					atomic.AddInt64(&upgrades, -1)
+					rejectedTotal.Inc(config.Name, "limit")
+					return echo.NewHTTPError(http.StatusServiceUnavailable, "too many websocket connections")
+				case config.MaxWebSockets > 0:
+					defer atomic.AddInt64(&upgrades, -1)
+				}
+			} else {
+				// Only an upgrade may carry Upgrade upstream, the remaining
+				// hop-by-hop headers are dropped by the reverse proxy.
+				req.Header.Del(echo.HeaderUpgrade)
+			}
+
+			tgt := config.Balancer.Next(c)
+			c.Set(config.ContextKey, tgt)
+
+			// Fix header
+			if req.Header.Get(echo.HeaderXRealIP) == "" || c.Echo().IPExtractor != nil {
+				req.Header.Set(echo.HeaderXRealIP, c.RealIP())
+			}
+			if req.Header.Get(echo.HeaderXForwardedProto) == "" {
+				req.Header.Set(echo.HeaderXForwardedProto, c.Scheme())
+			}
+
+			if accepts(req, eventStream) {
+				// A compressing upstream would buffer the events. Removing
+				// the header is not enough, the transport would then ask for
+				// gzip itself.
+				req.Header.Set(echo.HeaderAcceptEncoding, "identity")
+			}
+
+			proxy := httputil.NewSingleHostReverseProxy(tgt.URL)
+			proxy.Transport = config.Transport
+			proxy.FlushInterval = flushInterval(config, req.URL.Path)
+			proxy.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, e error) {
+				err = proxyError(tgt, e)
+			}
+			proxy.ModifyResponse = func(res *http.Response) error {
+				if config.ModifyResponse != nil {
+					if err := config.ModifyResponse(res); err != nil {
+						return err
+					}
+				}
+				if res.StatusCode == http.StatusSwitchingProtocols {
+					return trackUpgrade(res, config)
+				}
+				if isStream(res) || proxy.FlushInterval != 0 {
+					// Streams stay open for as long as the upstream keeps
+					// sending, so no write deadline applies to them.
+					_ = http.NewResponseController(c.Response().Writer).SetWriteDeadline(time.Time{})
+				}
+				return nil
+			}
+			proxy.ServeHTTP(c.Response(), req)
+			return
+		}
+	}
+}
+
+// isUpgrade reports whether req asks to switch protocols, listing upgrade
+// in its Connection header and naming the protocol in Upgrade.
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get(echo.HeaderUpgrade) == "" {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const eventStream = "text/event-stream"
+
+// accepts reports whether req lists mediaType in its Accept header.
+func accepts(req *http.Request, mediaType string) bool {
+	for _, value := range req.Header.Values(echo.HeaderAccept) {
+		for _, part := range strings.Split(value, ",") {
+			if t, _, err := mime.ParseMediaType(part); err == nil && t == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isStream reports whether res is a stream that may stay open for long,
+// Server-Sent Events or gRPC. Other responses of unknown length are flushed
+// as they arrive too but keep the write deadline, a client reading them
+// slowly must not hold the connection forever.
+func isStream(res *http.Response) bool {
+	t, _, _ := mime.ParseMediaType(res.Header.Get(echo.HeaderContentType))
+	return t == eventStream || t == "application/grpc" || strings.HasPrefix(t, "application/grpc+")
+}
+
+// flushInterval returns the flush interval for path.
+func flushInterval(config Config, path string) time.Duration {
+	interval, longest := config.FlushInterval, -1
+	for prefix, i := range config.FlushIntervals {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			interval, longest = i, len(prefix)
+		}
+	}
+	return interval
+}
+
+// proxyError reports a failed upstream round trip like echo's proxy does.
+func proxyError(tgt *middleware.ProxyTarget, err error) error {
+	desc := tgt.URL.String()
+	if tgt.Name != "" {
+		desc = fmt.Sprintf("%s(%s)", tgt.Name, tgt.URL.String())
+	}
+	// A client closing the connection is reported as a client error.
+	if err == context.Canceled || strings.Contains(err.Error(), "operation was canceled") {
+		httpError := echo.NewHTTPError(middleware.StatusCodeContextCanceled, fmt.Sprintf("client closed connection: %v", err))
+		httpError.Internal = err
+		return httpError
+	}
+	httpError := echo.NewHTTPError(http.StatusBadGateway, fmt.Sprintf("remote %s unreachable, could not forward: %v", desc, err))
+	httpError.Internal = err
+	return httpError
+}
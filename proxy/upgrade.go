@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/allnash/moxie/metrics"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	activeGauge = metrics.NewGauge("moxie_websocket_connections",
+		"Upgraded connections currently open.", "service")
+	upgradesTotal = metrics.NewCounter("moxie_websocket_connections_total",
+		"Connections upgraded since start.", "service")
+	closedTotal = metrics.NewCounter("moxie_websocket_closed_total",
+		"Upgraded connections closed by moxie, by reason.", "service", "reason")
+	rejectedTotal = metrics.NewCounter("moxie_websocket_rejected_total",
+		"Upgrade requests refused, by reason.", "service", "reason")
+)
+
+// connections holds every upgraded connection, for Shutdown.
+var connections = &tracker{conns: map[*upgradedConn]struct{}{}}
+
+type tracker struct {
+	mu       sync.Mutex
+	conns    map[*upgradedConn]struct{}
+	draining bool
+}
+
+func (t *tracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+func (t *tracker) add(c *upgradedConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+func (t *tracker) remove(c *upgradedConn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+func (t *tracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Shutdown refuses new upgrades and waits for the open upgraded connections
+// to finish, which http.Server.Shutdown does not do for hijacked
+// connections. Connections still open when ctx is done are closed and
+// ctx's error is returned.
+func Shutdown(ctx context.Context) error {
+	connections.mu.Lock()
+	connections.draining = true
+	connections.mu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for connections.len() > 0 {
+		select {
+		case <-ctx.Done():
+			connections.mu.Lock()
+			open := make([]*upgradedConn, 0, len(connections.conns))
+			for c := range connections.conns {
+				open = append(open, c)
+			}
+			connections.mu.Unlock()
+			for _, c := range open {
+				c.close("shutdown")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// upgradedConn wraps the upstream side of an upgraded connection. Both
+// directions pass through it, the reverse proxy reads what the upstream
+// sends and writes what the client sends, so it sees all activity.
+type upgradedConn struct {
+	io.ReadWriteCloser
+	service      string
+	idleTimeout  time.Duration
+	lastActivity int64 // unix nanoseconds
+	idleTimer    *time.Timer
+	lifeTimer    *time.Timer
+	closeOnce    sync.Once
+}
+
+// trackUpgrade wraps the body of a 101 response, which the reverse proxy
+// uses as the upstream connection.
+func trackUpgrade(res *http.Response, config Config) error {
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		return errors.New("upgrade response body is not writable")
+	}
+	c := &upgradedConn{
+		ReadWriteCloser: rwc,
+		service:         config.Name,
+		idleTimeout:     config.WebSocketIdleTimeout,
+		lastActivity:    time.Now().UnixNano(),
+	}
+	if !connections.add(c) {
+		rejectedTotal.Inc(config.Name, "shutdown")
+		return errors.New("server is shutting down")
+	}
+	activeGauge.Add(1, c.service)
+	upgradesTotal.Inc(c.service)
+	if c.idleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(c.idleTimeout, c.checkIdle)
+	}
+	if config.WebSocketMaxLifetime > 0 {
+		c.lifeTimer = time.AfterFunc(config.WebSocketMaxLifetime, func() { c.close("lifetime") })
+	}
+	res.Body = c
+	return nil
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *upgradedConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// checkIdle closes the connection once it has been idle for idleTimeout and
+// otherwise checks again when it would be.
+func (c *upgradedConn) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+	if idle >= c.idleTimeout {
+		c.close("idle")
+		return
+	}
+	c.idleTimer.Reset(c.idleTimeout - idle)
+}
+
+// Close is called by the reverse proxy once either side is done.
+func (c *upgradedConn) Close() error {
+	return c.close("")
+}
+
+// close closes the upstream side, which makes the reverse proxy close the
+// client side as well. A reason is given when moxie ends the connection.
+func (c *upgradedConn) close(reason string) error {
+	var err error
+	c.closeOnce.Do(func() {
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		if c.lifeTimer != nil {
+			c.lifeTimer.Stop()
+		}
+		err = c.ReadWriteCloser.Close()
+		connections.remove(c)
+		activeGauge.Add(-1, c.service)
+		if reason != "" {
+			closedTotal.Inc(c.service, reason)
+		}
+	})
+	return err
+}
@@ -1 +1 @@
-wget -q -O - https://git.io/vQhTU | bash -s -- --version 1.16
\ No newline at end of file
+wget -q -O - https://git.io/vQhTU | bash -s -- --version 1.26.0
\ No newline at end of file
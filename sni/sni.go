@@ -0,0 +1,99 @@
+package sni
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Map selects the tls.Config for a handshake from the ClientHello's server
+// name. Hosts may be exact names or wildcards of the form "*.example.com".
+// Clients that send no or an unknown server name get the default config.
+//
+// A Map is safe for concurrent use; configs can be replaced while the
+// listener is serving and only affect new handshakes.
+type Map struct {
+	mu    sync.RWMutex
+	hosts map[string]*tls.Config
+	def   *tls.Config
+}
+
+// NewMap returns a Map falling back to def, which may be nil.
+func NewMap(def *tls.Config) *Map {
+	return &Map{hosts: map[string]*tls.Config{}, def: def}
+}
+
+// Set stores the config for host. The port, if any, is ignored.
+func (m *Map) Set(host string, config *tls.Config) {
+	m.mu.Lock()
+	m.hosts[Hostname(host)] = config
+	m.mu.Unlock()
+}
+
+// Delete removes the config for host, whose handshakes then get the
+// default config or a wildcard entry's.
+func (m *Map) Delete(host string) {
+	m.mu.Lock()
+	delete(m.hosts, Hostname(host))
+	m.mu.Unlock()
+}
+
+// SetDefault replaces the default config.
+func (m *Map) SetDefault(config *tls.Config) {
+	m.mu.Lock()
+	m.def = config
+	m.mu.Unlock()
+}
+
+// Lookup returns the config for serverName, falling back to a wildcard
+// entry and then to the default.
+func (m *Map) Lookup(serverName string) *tls.Config {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if config, ok := m.hosts[name]; ok {
+		return config
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if config, ok := m.hosts["*"+name[i:]]; ok {
+			return config
+		}
+	}
+	return m.def
+}
+
+// Each calls fn for every host and the default (with host "").
+func (m *Map) Each(fn func(host string, config *tls.Config)) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.def != nil {
+		fn("", m.def)
+	}
+	for host, config := range m.hosts {
+		fn(host, config)
+	}
+}
+
+// GetConfigForClient implements tls.Config.GetConfigForClient.
+func (m *Map) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	config := m.Lookup(hello.ServerName)
+	if config == nil {
+		return nil, errors.New("sni: no certificate for " + hello.ServerName)
+	}
+	return config, nil
+}
+
+// TLSConfig returns a server config that dispatches handshakes through m.
+func (m *Map) TLSConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: m.GetConfigForClient}
+}
+
+// Hostname returns host lower-cased and without a port.
+func Hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
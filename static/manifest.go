@@ -0,0 +1,143 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives manifest reloads and errors.
+type Logger interface {
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Manifest maps the names of static files to the names with a content hash
+// Django's ManifestStaticFilesStorage gives them, as collectstatic writes them
+// to staticfiles.json. The file is polled and reloaded when collectstatic runs
+// again, a file that does not parse, e.g. one still being written, is retried
+// on its next change.
+type Manifest struct {
+	// File is the path of staticfiles.json.
+	// Required.
+	File string
+
+	// Interval is how often File is checked.
+	// default 10 seconds
+	Interval time.Duration
+
+	// Logger receives reload errors.
+	// Optional.
+	Logger Logger
+
+	mu     sync.RWMutex
+	paths  map[string]string // name to hashed name
+	hashed map[string]bool
+	stamp  string // modification time and size of File
+	failed string // stamp of the last change that failed to load
+}
+
+// manifestFile is the format of staticfiles.json, versions 1.0 and 1.1.
+type manifestFile struct {
+	Paths   map[string]string `json:"paths"`
+	Version string            `json:"version"`
+}
+
+// LoadManifest reads file.
+func LoadManifest(file string) (*Manifest, error) {
+	m := &Manifest{File: file}
+	if err := m.load(manifestStamp(file)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manifest) load(stamp string) error {
+	b, err := os.ReadFile(m.File)
+	if err != nil {
+		return err
+	}
+	var f manifestFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("%s: %v", m.File, err)
+	}
+	if f.Paths == nil {
+		return fmt.Errorf("%s: no paths, not a staticfiles.json", m.File)
+	}
+	hashed := make(map[string]bool, len(f.Paths))
+	for name, hashedName := range f.Paths {
+		if hashedName != name {
+			hashed[hashedName] = true
+		}
+	}
+	m.mu.Lock()
+	m.paths, m.hashed, m.stamp = f.Paths, hashed, stamp
+	m.mu.Unlock()
+	return nil
+}
+
+// Start polls File in the background.
+func (m *Manifest) Start() {
+	if m.Interval == 0 {
+		m.Interval = 10 * time.Second
+	}
+	go func() {
+		for range time.Tick(m.Interval) {
+			m.check()
+		}
+	}()
+}
+
+func (m *Manifest) check() {
+	current := manifestStamp(m.File)
+	m.mu.RLock()
+	unchanged := current == m.stamp || current == m.failed || current == ""
+	m.mu.RUnlock()
+	if unchanged {
+		return
+	}
+	if err := m.load(current); err != nil {
+		m.mu.Lock()
+		m.failed = current
+		m.mu.Unlock()
+		if m.Logger != nil {
+			m.Logger.Errorf("reloading manifest %v, keeping the current one", err)
+		}
+		return
+	}
+	if m.Logger != nil {
+		m.mu.RLock()
+		n := len(m.paths)
+		m.mu.RUnlock()
+		m.Logger.Warnf("reloaded manifest %s with %d files", m.File, n)
+	}
+}
+
+// Lookup returns the hashed name of name, both relative to the static root
+// with slashes and no leading slash.
+func (m *Manifest) Lookup(name string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	hashed, ok := m.paths[strings.TrimPrefix(name, "/")]
+	return hashed, ok
+}
+
+// Hashed reports whether name is the hashed name of a file.
+func (m *Manifest) Hashed(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.hashed[strings.TrimPrefix(name, "/")]
+}
+
+// manifestStamp returns the modification time and size of file, empty when it
+// is missing.
+func manifestStamp(file string) string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
@@ -0,0 +1,323 @@
+package static
+
+import (
+	"fmt"
+	"github.com/allnash/moxie/compress"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/bytes"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Config defines the config for Static middleware.
+//
+// Files under Root are served at their path. A request for a file with a
+// precompressed sibling, "app.js.br" next to "app.js", gets the sibling
+// when its Accept-Encoding allows, so assets compressed at build time at the
+// highest levels are not compressed again on every request.
+//
+// With a Manifest, files with a hashed name are served with
+// ImmutableCacheControl, and requests for their original name may be
+// redirected to the hashed one or served its content.
+type Config struct {
+	// Skipper defines a function to skip middleware.
+	// default middleware.DefaultSkipper
+	Skipper middleware.Skipper
+
+	// Root directory of the files.
+	// Required.
+	Root string
+
+	// Index file served for directories.
+	// default "index.html"
+	Index string
+
+	// HTML5 serves the index of Root for paths not found, for single page
+	// applications routing on the client.
+	// Optional.
+	HTML5 bool
+
+	// Browse lists directories without an index.
+	// Optional.
+	Browse bool
+
+	// Precompressed are the encodings whose siblings are served, preferred
+	// first, out of "br" (.br), "zstd" (.zst) and "gzip" (.gz).
+	// default ["br", "zstd", "gzip"]
+	Precompressed []string
+
+	// ContextKey stores the path of the file served, relative to Root, in
+	// the context.
+	// default "static_file"
+	ContextKey string
+
+	// Manifest of the hashed names of the files.
+	// Optional.
+	Manifest *Manifest
+
+	// Unhashed is what requests for the original name of a file in
+	// Manifest get: "serve" the file of that name, "redirect" to the hashed
+	// name, or "rewrite" to serve the hashed file, whose content may
+	// differ, e.g. CSS referencing other hashed names.
+	// default "serve"
+	Unhashed string
+}
+
+// ImmutableCacheControl is the Cache-Control of files with a hashed name,
+// which never change.
+const ImmutableCacheControl = "public, max-age=31536000, immutable"
+
+// DefaultConfig is the default Static middleware config
+var DefaultConfig = Config{
+	Skipper:       middleware.DefaultSkipper,
+	Index:         "index.html",
+	Precompressed: []string{"br", "zstd", "gzip"},
+	ContextKey:    "static_file",
+	Unhashed:      "serve",
+}
+
+// extensions of the precompressed siblings by encoding.
+var extensions = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+var listing = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>{{ .Name }}</title>
+<style>
+body { font-family: Menlo, Consolas, monospace; padding: 48px; }
+li { padding: 4px 0; }
+a { text-decoration: none; }
+span { color: #707070; font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>{{ .Name }}</h1>
+<ul>
+{{ range .Files }}<li><a href="{{ .Href }}">{{ .Name }}</a> {{ if .Size }}<span>{{ .Size }}</span>{{ end }}</li>
+{{ end }}</ul>
+</body>
+</html>
+`))
+
+// Middleware returns a Static middleware serving root.
+func Middleware(root string) echo.MiddlewareFunc {
+	c := DefaultConfig
+	c.Root = root
+	return MiddlewareWithConfig(c)
+}
+
+// MiddlewareWithConfig returns a Static middleware with config.
+// See: `Middleware()`.
+func MiddlewareWithConfig(config Config) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultConfig.Skipper
+	}
+	if config.Root == "" {
+		panic("echo: static middleware requires a root")
+	}
+	if config.Index == "" {
+		config.Index = DefaultConfig.Index
+	}
+	if config.ContextKey == "" {
+		config.ContextKey = DefaultConfig.ContextKey
+	}
+	if config.Unhashed == "" {
+		config.Unhashed = DefaultConfig.Unhashed
+	}
+	switch config.Unhashed {
+	case "serve", "redirect", "rewrite":
+	default:
+		panic("echo: static middleware unhashed must be serve, redirect or rewrite, not " + config.Unhashed)
+	}
+	if config.Precompressed == nil {
+		config.Precompressed = DefaultConfig.Precompressed
+	}
+	for _, encoding := range config.Precompressed {
+		if extensions[encoding] == "" {
+			panic("echo: static middleware does not support precompressed encoding " + encoding)
+		}
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) {
+				return next(c)
+			}
+			p, err := url.PathUnescape(c.Request().URL.Path)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			p = path.Clean("/" + p) // "/"+ keeps requests under Root
+			name := filepath.Join(config.Root, filepath.FromSlash(p))
+			if config.Manifest != nil && config.Unhashed != "serve" {
+				if hashed, ok := config.Manifest.Lookup(p); ok && "/"+hashed != p {
+					if config.Unhashed == "redirect" {
+						// Temporary, the next collectstatic may hash it
+						// differently.
+						c.Response().Header().Set("Cache-Control", "no-cache")
+						u := url.URL{Path: "/" + hashed, RawQuery: c.Request().URL.RawQuery}
+						return c.Redirect(http.StatusFound, u.String())
+					}
+					hashedName := filepath.Join(config.Root, filepath.FromSlash(hashed))
+					if info, err := os.Stat(hashedName); err == nil && info.Mode().IsRegular() {
+						return serveFile(c, &config, hashedName, p)
+					}
+				}
+			}
+			info, err := os.Stat(name)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					return err
+				}
+				if err = next(c); err == nil {
+					return nil
+				}
+				if he, ok := err.(*echo.HTTPError); !ok || !config.HTML5 || he.Code != http.StatusNotFound {
+					return err
+				}
+				p = "/" + config.Index
+				name = filepath.Join(config.Root, config.Index)
+				if info, err = os.Stat(name); err != nil {
+					return err
+				}
+			}
+			if info.IsDir() {
+				index := filepath.Join(name, config.Index)
+				if indexInfo, err := os.Stat(index); err == nil && !indexInfo.IsDir() {
+					return serveFile(c, &config, index, path.Join(p, config.Index))
+				}
+				if config.Browse {
+					return listDir(c, name, p)
+				}
+				return next(c)
+			}
+			return serveFile(c, &config, name, p)
+		}
+	}
+}
+
+// serveFile serves the file at name, or its precompressed sibling in the
+// encoding the client prefers, as the file at urlPath.
+func serveFile(c echo.Context, config *Config, name, urlPath string) error {
+	res := c.Response()
+	file, info, err := open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	content, tag := io.ReadSeeker(file), etag(info)
+	c.Set(config.ContextKey, urlPath)
+	if config.Manifest != nil && config.Manifest.Hashed(urlPath) {
+		res.Header().Set("Cache-Control", ImmutableCacheControl)
+	}
+
+	var available []string
+	for _, encoding := range config.Precompressed {
+		if sibling, err := os.Stat(name + extensions[encoding]); err == nil && sibling.Mode().IsRegular() {
+			available = append(available, encoding)
+		}
+	}
+	if len(available) > 0 {
+		res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+		encoding := compress.Negotiate(c.Request().Header.Get(echo.HeaderAcceptEncoding), available)
+		if encoding != "" {
+			if sibling, siblingInfo, err := open(name + extensions[encoding]); err == nil {
+				defer sibling.Close()
+				res.Header().Set(echo.HeaderContentType, contentType(name, file))
+				res.Header().Set(echo.HeaderContentEncoding, encoding)
+				content, tag = sibling, etag(siblingInfo)
+			}
+		}
+	}
+	// ServeContent answers If-None-Match, If-Modified-Since, Range and
+	// If-Range with these.
+	res.Header().Set("ETag", tag)
+	http.ServeContent(res, c.Request(), info.Name(), info.ModTime(), content)
+	return nil
+}
+
+// open opens the file at name along with its info, which describes what is
+// read even if the file is replaced meanwhile.
+func open(name string) (*os.File, os.FileInfo, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// etag returns a strong entity tag of the file described by info. Each
+// precompressed sibling has its own, ranges of one are not ranges of the
+// others.
+func etag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// contentType returns the media type of the file at name by its extension or
+// else its content, which a precompressed sibling does not reveal.
+func contentType(name string, file io.ReadSeeker) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(file, buf[:])
+	file.Seek(0, io.SeekStart)
+	return http.DetectContentType(buf[:n])
+}
+
+// listDir lists the directory at name, requested as urlPath.
+func listDir(c echo.Context, name, urlPath string) error {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	type file struct {
+		Name, Href, Size string
+	}
+	files := make([]file, 0, len(entries))
+	for _, entry := range entries {
+		f := file{Name: entry.Name(), Href: (&url.URL{Path: entry.Name()}).String()}
+		if entry.IsDir() {
+			f.Name += "/"
+			f.Href += "/"
+		} else if info, err := entry.Info(); err == nil {
+			f.Size = bytes.Format(info.Size())
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	if !strings.HasSuffix(urlPath, "/") {
+		// Links are relative to the directory.
+		for i := range files {
+			files[i].Href = path.Base(urlPath) + "/" + files[i].Href
+		}
+	}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	res.WriteHeader(http.StatusOK)
+	return listing.Execute(res, struct {
+		Name  string
+		Files []file
+	}{urlPath, files})
+}
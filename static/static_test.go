@@ -0,0 +1,96 @@
+package static
+
+import (
+	"compress/gzip"
+	"github.com/allnash/moxie/compress"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var content = strings.Repeat("console.log('moxie');\n", 200)
+
+// newTestServer serves a directory holding app.js through the Compress
+// middleware, as static services are.
+func newTestServer(t *testing.T) *echo.Echo {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "app.js"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(compress.Middleware())
+	e.Use(Middleware(root))
+	return e
+}
+
+func get(e *echo.Echo, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+	req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCompressedWeakETag(t *testing.T) {
+	e := newTestServer(t)
+
+	rec := get(e, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentEncoding) != "gzip" {
+		t.Fatalf("got %d %q, want %d gzip", rec.Code, rec.Header().Get(echo.HeaderContentEncoding), http.StatusOK)
+	}
+	tag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(tag, `W/"`) {
+		t.Fatalf("compressed response ETag %q, want a weak one", tag)
+	}
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || string(b) != content {
+		t.Fatalf("decompressed %d bytes, %v", len(b), err)
+	}
+
+	rec = get(e, map[string]string{"If-None-Match": tag})
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != tag {
+		t.Fatalf("If-None-Match %s got %d %q, want %d with the same tag", tag, rec.Code, rec.Header().Get("ETag"), http.StatusNotModified)
+	}
+}
+
+func TestRangeNotCompressed(t *testing.T) {
+	e := newTestServer(t)
+
+	rec := get(e, map[string]string{"Range": "bytes=0-9"})
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("got %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if rec.Header().Get(echo.HeaderContentEncoding) != "" || rec.Body.String() != content[:10] {
+		t.Fatalf("range got %q encoded %q, want %q as is", rec.Body.String(), rec.Header().Get(echo.HeaderContentEncoding), content[:10])
+	}
+	if tag := rec.Header().Get("ETag"); strings.HasPrefix(tag, "W/") {
+		t.Fatalf("range ETag %q, want the strong one", tag)
+	}
+}
+
+func TestIfRangeWeakTag(t *testing.T) {
+	e := newTestServer(t)
+	tag := get(e, nil).Header().Get("ETag")
+
+	// Weak tags never match If-Range, the whole file is sent.
+	rec := get(e, map[string]string{"Range": "bytes=0-9", "If-Range": tag})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("If-Range %s got %d, want %d", tag, rec.Code, http.StatusOK)
+	}
+	strong := strings.TrimPrefix(tag, "W/")
+	rec = get(e, map[string]string{"Range": "bytes=0-9", "If-Range": strong})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != content[:10] {
+		t.Fatalf("If-Range %s got %d %q, want %d %q", strong, rec.Code, rec.Body.String(), http.StatusPartialContent, content[:10])
+	}
+}
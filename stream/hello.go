@@ -0,0 +1,67 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errHelloRead = errors.New("client hello read")
+
+// ServerName reads the TLS ClientHello from conn and returns the server name
+// it asks for, empty when it sends none, and a connection replaying the
+// bytes read, to be proxied or handed to a TLS server. An error is returned
+// when conn does not start with a ClientHello within timeout, along with the
+// replaying connection for a server to answer what was sent instead.
+func ServerName(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	var peeked bytes.Buffer
+	var name string
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	// Let crypto/tls parse the hello and stop the handshake right after.
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	replayed := &replayConn{Conn: conn, r: io.MultiReader(&peeked, conn)}
+	if !errors.Is(err, errHelloRead) {
+		return "", replayed, err
+	}
+	return name, replayed, nil
+}
+
+// readOnlyConn records what the TLS server reads and discards its writes,
+// the alert it sends when the handshake is stopped.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c readOnlyConn) Close() error                { return nil }
+
+// replayConn reads the peeked bytes before the rest of the connection.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// CloseWrite half-closes the underlying TCP connection.
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// PassthroughListener shares a TLS listener between moxie and upstreams
+// terminating TLS themselves. It reads the ClientHello of each accepted
+// connection and hands those asking for a server name of Routes to its
+// proxy, which splices them to an upstream of its Pool. The others are
+// returned by Accept, replaying the ClientHello, for an HTTP server to
+// terminate TLS.
+type PassthroughListener struct {
+	net.Listener
+
+	// Routes map server names, exact or wildcards like "*.example.com", to
+	// the proxies passing them through. Their Routes and TLSConfig are not
+	// used.
+	Routes map[string]*TCPProxy
+
+	conns     chan net.Conn
+	done      chan struct{} // closed when accepting stops
+	err       error
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Passthrough returns a listener passing the connections of l for the server
+// names of routes through.
+func Passthrough(l net.Listener, routes map[string]*TCPProxy) *PassthroughListener {
+	pl := &PassthroughListener{
+		Listener: l,
+		Routes:   routes,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go pl.serve()
+	return pl
+}
+
+func (l *PassthroughListener) serve() {
+	defer close(l.done)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			return
+		}
+		// Reading the hello may take a while, do not hold up the others.
+		go l.handle(conn)
+	}
+}
+
+func (l *PassthroughListener) handle(conn net.Conn) {
+	name, replayed, err := ServerName(conn, helloTimeout)
+	if err == nil {
+		if p := l.route(name); p != nil {
+			if p.Filter != nil && !p.Filter.AllowedString(remoteIP(conn.RemoteAddr())) {
+				conn.Close()
+				return
+			}
+			p.pipe(replayed, p.Pool)
+			return
+		}
+	}
+	// Errors are left to the TLS server, which logs them like any other
+	// failed handshake.
+	select {
+	case l.conns <- replayed:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// route returns the proxy for a server name.
+func (l *PassthroughListener) route(name string) *TCPProxy {
+	for _, key := range routeKeys(name) {
+		if p, ok := l.Routes[key]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// Accept returns the next connection not passed through.
+func (l *PassthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting. Connections passed through are left open, see
+// TCPProxy.Shutdown.
+func (l *PassthroughListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
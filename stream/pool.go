@@ -0,0 +1,149 @@
+package stream
+
+import (
+	"github.com/allnash/moxie/metrics"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	connectionsGauge = metrics.NewGauge("moxie_stream_connections",
+		"TCP connections and UDP sessions currently proxied.", "service")
+	upstreamUpGauge = metrics.NewGauge("moxie_stream_upstream_up",
+		"Whether an upstream passed its last health check.", "service", "upstream")
+)
+
+// Logger receives health and connection errors.
+type Logger interface {
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Pool balances connections round robin over upstream addresses, passing
+// over those that failed their last health check. An upstream is checked by
+// connecting to it over TCP and is also taken out when a connection to it
+// fails.
+type Pool struct {
+	// Addresses are the upstreams as host:port.
+	// Required.
+	Addresses []string
+
+	// Name identifies the service in metrics and logs.
+	// Optional.
+	Name string
+
+	// Interval between health checks, negative disables them.
+	// default 10 seconds
+	Interval time.Duration
+
+	// Logger receives upstream state changes.
+	// Optional.
+	Logger Logger
+
+	mu   sync.Mutex
+	next int
+	down map[string]bool
+	stop chan struct{}
+}
+
+// Start starts health checking.
+func (p *Pool) Start() {
+	for _, addr := range p.Addresses {
+		upstreamUpGauge.Set(1, p.Name, addr)
+	}
+	interval := p.Interval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	if interval < 0 {
+		return
+	}
+	p.mu.Lock()
+	p.stop = make(chan struct{})
+	stop := p.stop
+	p.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.check()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops health checking.
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+func (p *Pool) check() {
+	for _, addr := range p.Addresses {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			p.MarkDown(addr, err)
+			continue
+		}
+		conn.Close()
+		p.markUp(addr)
+	}
+}
+
+// Candidates returns the upstreams to try for a new connection, the healthy
+// ones starting at the next in turn, then the unhealthy ones. These are still
+// tried, a health check may be out of date.
+func (p *Pool) Candidates() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var healthy, unhealthy []string
+	for _, addr := range p.Addresses {
+		if p.down[addr] {
+			unhealthy = append(unhealthy, addr)
+		} else {
+			healthy = append(healthy, addr)
+		}
+	}
+	if n := len(healthy); n > 0 {
+		i := p.next % n
+		p.next = i + 1
+		healthy = append(healthy[i:], healthy[:i]...)
+	}
+	return append(healthy, unhealthy...)
+}
+
+// MarkDown takes addr out of rotation until it passes a health check, a
+// connection to it succeeds or, over UDP, it replies.
+func (p *Pool) MarkDown(addr string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down == nil {
+		p.down = map[string]bool{}
+	}
+	if !p.down[addr] && p.Logger != nil {
+		p.Logger.Warnf("%s: upstream %s is down: %v", p.Name, addr, err)
+	}
+	p.down[addr] = true
+	upstreamUpGauge.Set(0, p.Name, addr)
+}
+
+func (p *Pool) markUp(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down[addr] {
+		delete(p.down, addr)
+		if p.Logger != nil {
+			p.Logger.Warnf("%s: upstream %s is up", p.Name, addr)
+		}
+	}
+	upstreamUpGauge.Set(1, p.Name, addr)
+}
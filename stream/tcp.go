@@ -0,0 +1,358 @@
+package stream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/allnash/moxie/ipfilter"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// helloTimeout limits reading the ClientHello of connections routed by it.
+const helloTimeout = 10 * time.Second
+
+// TCPProxy forwards TCP connections to the upstreams of a Pool. Connections
+// may be routed by the server name of their TLS ClientHello without being
+// terminated, or have TLS terminated by moxie.
+type TCPProxy struct {
+	// Name identifies the service in metrics and logs.
+	// Optional.
+	Name string
+
+	// Pool is where connections go.
+	// Required.
+	Pool *Pool
+
+	// Routes send TLS connections by the server name of their ClientHello,
+	// an exact name or a wildcard like "*.example.com", to other pools
+	// without terminating TLS. Connections matching no route go to Pool.
+	// Optional.
+	Routes map[string]*Pool
+
+	// TLSConfig terminates TLS of connections not routed by Routes, the
+	// upstream gets the plain stream. Its ALPN protocols are not offered.
+	// Optional.
+	TLSConfig *tls.Config
+
+	// Filter rejects clients by IP.
+	// Optional.
+	Filter *ipfilter.Filter
+
+	// IdleTimeout closes connections without traffic in either direction.
+	// default 5 minutes
+	IdleTimeout time.Duration
+
+	// DialTimeout limits connecting to an upstream.
+	// default 10 seconds
+	DialTimeout time.Duration
+
+	// Logger receives connection errors.
+	// Optional.
+	Logger Logger
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[*splice]struct{}
+	closing   bool
+}
+
+// Serve accepts connections on l until it is closed.
+func (p *TCPProxy) Serve(l net.Listener) error {
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	p.listeners = append(p.listeners, l)
+	p.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if p.isClosing() {
+				return nil
+			}
+			return err
+		}
+		go p.Handle(conn)
+	}
+}
+
+// Handle proxies conn.
+func (p *TCPProxy) Handle(conn net.Conn) {
+	if p.Filter != nil && !p.Filter.AllowedString(remoteIP(conn.RemoteAddr())) {
+		conn.Close()
+		return
+	}
+	pool := p.Pool
+	if len(p.Routes) > 0 {
+		name, replayed, err := ServerName(conn, helloTimeout)
+		if err != nil {
+			if p.TLSConfig != nil || !isNotTLS(err) {
+				p.errorf("%s: reading client hello from %s: %v", p.Name, conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			// Not TLS, nothing to route by.
+		} else if routed := p.route(name); routed != nil {
+			p.pipe(replayed, routed)
+			return
+		}
+		conn = replayed
+	}
+	if p.TLSConfig != nil {
+		tlsConn := tls.Server(conn, terminate(p.TLSConfig))
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			p.errorf("%s: TLS handshake with %s: %v", p.Name, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	p.pipe(conn, pool)
+}
+
+// route returns the pool for a server name.
+func (p *TCPProxy) route(name string) *Pool {
+	for _, key := range routeKeys(name) {
+		if pool, ok := p.Routes[key]; ok {
+			return pool
+		}
+	}
+	return nil
+}
+
+// routeKeys returns the route keys matching a server name, in order of
+// preference: the name itself and the wildcard of its parent domain.
+func routeKeys(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return []string{name, "*" + name[i:]}
+	}
+	return []string{name}
+}
+
+// pipe connects conn to an upstream of pool and copies both ways.
+func (p *TCPProxy) pipe(conn net.Conn, pool *Pool) {
+	upstream, err := p.dial(pool)
+	if err != nil {
+		p.errorf("%s: no upstream for %s: %v", p.Name, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	idle := p.IdleTimeout
+	if idle == 0 {
+		idle = 5 * time.Minute
+	}
+	s := &splice{client: conn, upstream: upstream, idleTimeout: idle}
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+	s.idleTimer = time.AfterFunc(idle, s.checkIdle)
+	if !p.add(s) {
+		s.idleTimer.Stop()
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	defer p.remove(s)
+	s.run()
+}
+
+// dial connects to the first reachable candidate of pool.
+func (p *TCPProxy) dial(pool *Pool) (net.Conn, error) {
+	timeout := p.DialTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	err := errors.New("no upstreams")
+	for _, addr := range pool.Candidates() {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+		if err == nil {
+			pool.markUp(addr)
+			return conn, nil
+		}
+		pool.MarkDown(addr, err)
+	}
+	return nil, err
+}
+
+func (p *TCPProxy) add(s *splice) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closing {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = map[*splice]struct{}{}
+	}
+	p.conns[s] = struct{}{}
+	connectionsGauge.Add(1, p.Name)
+	return true
+}
+
+func (p *TCPProxy) remove(s *splice) {
+	p.mu.Lock()
+	delete(p.conns, s)
+	p.mu.Unlock()
+	connectionsGauge.Add(-1, p.Name)
+}
+
+func (p *TCPProxy) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+// Shutdown stops accepting and waits for open connections to finish. When
+// ctx is done they are closed and ctx's error is returned.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closing = true
+	for _, l := range p.listeners {
+		l.Close()
+	}
+	p.mu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		p.mu.Lock()
+		open := make([]*splice, 0, len(p.conns))
+		for s := range p.conns {
+			open = append(open, s)
+		}
+		p.mu.Unlock()
+		if len(open) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, s := range open {
+				s.close()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *TCPProxy) errorf(format string, args ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Errorf(format, args...)
+	}
+}
+
+// splice copies between a client and an upstream connection.
+type splice struct {
+	client, upstream net.Conn
+	idleTimeout      time.Duration
+	idleTimer        *time.Timer
+	lastActivity     int64 // unix nanoseconds
+	closeOnce        sync.Once
+}
+
+func (s *splice) run() {
+	done := make(chan struct{}, 2)
+	go s.copy(s.upstream, s.client, done)
+	go s.copy(s.client, s.upstream, done)
+	<-done
+	<-done
+	s.close()
+}
+
+// copy copies src to dst and half-closes dst at the end, so protocols that
+// shut down one direction first keep working.
+func (s *splice) copy(dst, src net.Conn, done chan struct{}) {
+	defer func() { done <- struct{}{} }()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				s.close()
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.close()
+				return
+			}
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			} else {
+				s.close()
+			}
+			return
+		}
+	}
+}
+
+// checkIdle closes the connection once it has been idle for idleTimeout and
+// otherwise checks again when it would be.
+func (s *splice) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActivity)))
+	if idle >= s.idleTimeout {
+		s.close()
+		return
+	}
+	s.idleTimer.Reset(s.idleTimeout - idle)
+}
+
+func (s *splice) close() {
+	s.closeOnce.Do(func() {
+		s.idleTimer.Stop()
+		s.client.Close()
+		s.upstream.Close()
+	})
+}
+
+// remoteIP returns the IP of a peer address.
+func remoteIP(addr net.Addr) string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// isNotTLS reports whether err comes from a client not speaking TLS.
+func isNotTLS(err error) bool {
+	var header tls.RecordHeaderError
+	return errors.As(err, &header)
+}
+
+// terminate returns config for terminating TLS of raw streams, which do not
+// negotiate the HTTP protocols the listener's configs offer via ALPN.
+func terminate(config *tls.Config) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c := config
+			if config.GetConfigForClient != nil {
+				var err error
+				if c, err = config.GetConfigForClient(hello); err != nil || c == nil {
+					return c, err
+				}
+			}
+			c = c.Clone()
+			c.NextProtos = nil
+			return c, nil
+		},
+	}
+}
@@ -0,0 +1,245 @@
+package stream
+
+import (
+	"errors"
+	"github.com/allnash/moxie/ipfilter"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// UDPProxy forwards datagrams to the upstreams of a Pool. Each client
+// address gets a session with its own socket toward one upstream, replies
+// arriving on it are sent back to the client. A session ends when idle, and
+// datagrams from new clients are dropped while MaxSessions are open, as
+// source addresses cost nothing to spoof and each session holds a socket.
+//
+// The pool's health checks connect over TCP, pools of UDP upstreams are
+// meant to run without them: an upstream answering a datagram with ICMP port
+// unreachable is taken out until a session to it gets a reply.
+type UDPProxy struct {
+	// Name identifies the service in metrics and logs.
+	// Optional.
+	Name string
+
+	// Pool is where sessions go.
+	// Required.
+	Pool *Pool
+
+	// Filter rejects clients by IP.
+	// Optional.
+	Filter *ipfilter.Filter
+
+	// IdleTimeout ends sessions without datagrams in either direction.
+	// default 1 minute
+	IdleTimeout time.Duration
+
+	// MaxSessions open at once.
+	// default 1024
+	MaxSessions int
+
+	// Logger receives upstream errors.
+	// Optional.
+	Logger Logger
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	sessions map[string]*udpSession
+	closing  bool
+	full     bool // MaxSessions reached, logged once until sessions end
+}
+
+const maxDatagram = 64 * 1024
+
+var errSessionsFull = errors.New("too many sessions")
+
+// Serve forwards the datagrams received on conn until Close is called.
+func (p *UDPProxy) Serve(conn net.PacketConn) error {
+	p.mu.Lock()
+	p.conn = conn
+	p.sessions = map[string]*udpSession{}
+	p.mu.Unlock()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			p.mu.Lock()
+			closing := p.closing
+			p.mu.Unlock()
+			if closing {
+				return nil
+			}
+			return err
+		}
+		if p.Filter != nil && !p.Filter.AllowedString(remoteIP(client)) {
+			continue
+		}
+		s, err := p.session(client)
+		if err == errSessionsFull {
+			continue
+		}
+		if err != nil {
+			if p.Logger != nil {
+				p.Logger.Errorf("%s: no upstream for %s: %v", p.Name, client, err)
+			}
+			continue
+		}
+		s.touch()
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			s.close()
+		}
+	}
+}
+
+// session returns the session of client, starting one if needed.
+func (p *UDPProxy) session(client net.Addr) (*udpSession, error) {
+	key := client.String()
+	max := p.MaxSessions
+	if max == 0 {
+		max = 1024
+	}
+	p.mu.Lock()
+	s, ok := p.sessions[key]
+	full := !ok && len(p.sessions) >= max
+	logFull := full && !p.full
+	if full {
+		p.full = true
+	}
+	p.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+	if full {
+		if logFull && p.Logger != nil {
+			p.Logger.Warnf("%s: %d sessions open, dropping datagrams of new clients", p.Name, max)
+		}
+		return nil, errSessionsFull
+	}
+
+	var upstream net.Conn
+	var addr string
+	err := errors.New("no upstreams")
+	for _, addr = range p.Pool.Candidates() {
+		if upstream, err = net.Dial("udp", addr); err == nil {
+			break
+		}
+		p.Pool.MarkDown(addr, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	idle := p.IdleTimeout
+	if idle == 0 {
+		idle = time.Minute
+	}
+	s = &udpSession{proxy: p, key: key, addr: addr, client: client, upstream: upstream, idleTimeout: idle}
+	s.touch()
+	s.idleTimer = time.AfterFunc(idle, s.checkIdle)
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		s.idleTimer.Stop()
+		upstream.Close()
+		return nil, errors.New("shutting down")
+	}
+	p.sessions[key] = s
+	p.mu.Unlock()
+	connectionsGauge.Add(1, p.Name)
+	go s.replies()
+	return s, nil
+}
+
+// Close stops serving and ends every session.
+func (p *UDPProxy) Close() error {
+	p.mu.Lock()
+	p.closing = true
+	conn := p.conn
+	sessions := make([]*udpSession, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.mu.Unlock()
+	for _, s := range sessions {
+		s.close()
+	}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// udpSession relays the datagrams of one client.
+type udpSession struct {
+	proxy        *UDPProxy
+	key          string
+	addr         string // upstream address
+	client       net.Addr
+	upstream     net.Conn
+	idleTimeout  time.Duration
+	idleTimer    *time.Timer
+	lastActivity int64 // unix nanoseconds
+	closeOnce    sync.Once
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// replies sends the upstream's datagrams back to the client.
+func (s *udpSession) replies() {
+	buf := make([]byte, maxDatagram)
+	replied := false
+	for {
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// An ICMP port unreachable answered a datagram.
+				s.proxy.Pool.MarkDown(s.addr, err)
+			}
+			s.close()
+			return
+		}
+		if !replied {
+			replied = true
+			s.proxy.Pool.markUp(s.addr)
+		}
+		s.touch()
+		if _, err := s.proxy.conn.WriteTo(buf[:n], s.client); err != nil {
+			s.close()
+			return
+		}
+	}
+}
+
+// checkIdle ends the session once it has been idle for idleTimeout and
+// otherwise checks again when it would be.
+func (s *udpSession) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActivity)))
+	if idle >= s.idleTimeout {
+		s.close()
+		return
+	}
+	s.idleTimer.Reset(s.idleTimeout - idle)
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		s.idleTimer.Stop()
+		s.upstream.Close()
+		p := s.proxy
+		p.mu.Lock()
+		if p.sessions[s.key] == s {
+			delete(p.sessions, s.key)
+			p.full = false
+		}
+		p.mu.Unlock()
+		connectionsGauge.Add(-1, p.Name)
+	})
+}
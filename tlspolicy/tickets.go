@@ -0,0 +1,84 @@
+package tlspolicy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// LoadTicketKeys reads session ticket keys from path. The file holds one
+// base64 encoded 32 byte key per line (e.g. from `openssl rand -base64 32`).
+// The first key encrypts new tickets, the others are only used to decrypt
+// tickets issued before a rotation.
+func LoadTicketKeys(path string) ([][32]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys [][32]byte
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("tlspolicy: %s:%d: expected a base64 encoded 32 byte key", path, n)
+		}
+		var key [32]byte
+		copy(key[:], raw)
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("tlspolicy: no session ticket keys in %s", path)
+	}
+	return keys, nil
+}
+
+// WatchTicketKeys installs the keys from path on config and re-installs them
+// whenever the file changes, checking every interval. Rotating is then a
+// matter of prepending a new key to the file and dropping the oldest one.
+// Errors after the initial load are passed to logf and the previous keys are
+// kept.
+func WatchTicketKeys(config *tls.Config, path string, interval time.Duration, logf func(format string, args ...interface{})) error {
+	keys, err := LoadTicketKeys(path)
+	if err != nil {
+		return err
+	}
+	config.SetSessionTicketKeys(keys)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	modTime := info.ModTime()
+
+	go func() {
+		for range time.Tick(interval) {
+			info, err := os.Stat(path)
+			if err != nil {
+				logf("session ticket keys: %v", err)
+				continue
+			}
+			if info.ModTime().Equal(modTime) {
+				continue
+			}
+			keys, err := LoadTicketKeys(path)
+			if err != nil {
+				logf("session ticket keys: %v", err)
+				continue
+			}
+			config.SetSessionTicketKeys(keys)
+			modTime = info.ModTime()
+		}
+	}()
+	return nil
+}
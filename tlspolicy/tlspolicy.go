@@ -0,0 +1,131 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// Policy holds the handshake parameters applied to every server tls.Config.
+type Policy struct {
+	MinVersion       uint16
+	MaxVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	NextProtos       []string
+
+	SessionTicketsDisabled bool
+}
+
+// Profiles follow the Mozilla server side TLS recommendations.
+//
+// "modern" only allows TLS 1.3. "intermediate" also allows TLS 1.2 with
+// forward secret AEAD cipher suites, for older clients. Neither sets curves,
+// the crypto/tls defaults offer the X25519MLKEM768 post-quantum hybrid along
+// with X25519 and the NIST curves.
+var Profiles = map[string]Policy{
+	"modern": {
+		MinVersion: tls.VersionTLS13,
+	},
+	"intermediate": {
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+	},
+}
+
+// DefaultProfile is used when no profile is named.
+const DefaultProfile = "modern"
+
+// Profile returns the named profile.
+func Profile(name string) (Policy, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	p, ok := Profiles[name]
+	if !ok {
+		return Policy{}, fmt.Errorf("tlspolicy: unknown profile '%s'", name)
+	}
+	return p, nil
+}
+
+// Apply copies the policy onto config.
+func (p Policy) Apply(config *tls.Config) {
+	config.MinVersion = p.MinVersion
+	config.MaxVersion = p.MaxVersion
+	config.CipherSuites = p.CipherSuites
+	config.CurvePreferences = p.CurvePreferences
+	if len(p.NextProtos) > 0 {
+		config.NextProtos = p.NextProtos
+	}
+	config.SessionTicketsDisabled = p.SessionTicketsDisabled
+}
+
+// ParseVersion maps "1.0" to "1.3" to their tls.Version constants.
+func ParseVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tlspolicy: unknown TLS version '%s'", version)
+}
+
+// ParseCipherSuites maps IANA names such as
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" to their IDs. Suites Go considers
+// insecure are refused. Cipher suites only apply to TLS 1.2 and below.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	var ids []uint16
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		id, ok := known[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("tlspolicy: cipher suite %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("tlspolicy: unknown cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseCurves maps curve names ("X25519MLKEM768", "X25519", "P-256", "P-384",
+// "P-521") to IDs.
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	known := map[string]tls.CurveID{
+		"X25519MLKEM768": tls.X25519MLKEM768,
+		"X25519":         tls.X25519,
+		"P-256":          tls.CurveP256,
+		"P-384":          tls.CurveP384,
+		"P-521":          tls.CurveP521,
+	}
+	var ids []tls.CurveID
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("tlspolicy: unknown curve %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
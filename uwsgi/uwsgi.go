@@ -0,0 +1,182 @@
+package uwsgi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/allnash/moxie/cgienv"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Transport is an http.RoundTripper that forwards requests to a uWSGI
+// server over the uwsgi binary protocol, like nginx's uwsgi_pass. The
+// request is sent as CGI variables (see cgienv) followed by the body, and
+// the application's HTTP response is read back.
+//
+// The uwsgi protocol carries one request per connection, so connections
+// are not reused.
+type Transport struct {
+	// Network is "tcp" or "unix".
+	// Required.
+	Network string
+
+	// Address is a host:port or a socket path.
+	// Required.
+	Address string
+
+	// Params override or add uwsgi variables, e.g. UWSGI_SCRIPT.
+	// Optional.
+	Params map[string]string
+
+	// DialTimeout limits connecting to the server.
+	// default 30 seconds
+	DialTimeout time.Duration
+
+	// MaxMemoryBody is the largest request body of unknown length that is
+	// buffered in memory to compute its CONTENT_LENGTH, larger bodies are
+	// buffered in a temporary file.
+	// default 1 MB
+	MaxMemoryBody int64
+}
+
+const (
+	modifierWSGI = 0
+	maxVarsSize  = 1<<16 - 1
+)
+
+// ErrVarsTooLarge is returned when the request's variables, mostly its
+// headers, do not fit the 64 KB uwsgi packet.
+var ErrVarsTooLarge = errors.New("uwsgi: request headers too large")
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	closeBody := func() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+	}
+	maxMemory := t.MaxMemoryBody
+	if maxMemory == 0 {
+		maxMemory = 1 << 20
+	}
+	body, length, cleanup, err := cgienv.Body(req, maxMemory)
+	if err != nil {
+		closeBody()
+		return nil, err
+	}
+	sized := *req
+	sized.ContentLength = length
+	packet, err := encode(cgienv.Build(&sized, t.Params))
+	if err != nil {
+		closeBody()
+		cleanup()
+		return nil, err
+	}
+
+	timeout := t.DialTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(req.Context(), t.Network, t.Address)
+	if err != nil {
+		closeBody()
+		cleanup()
+		return nil, err
+	}
+	// Abort the exchange when the client goes away.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-req.Context().Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	copied := make(chan struct{})
+	finish := func() {
+		close(done)
+		conn.Close()
+		// The body may still be copied from the buffer cleanup removes.
+		// Closing conn ends the copy, unless it waits on a client still
+		// sending, which the response must not wait for.
+		go func() {
+			<-copied
+			cleanup()
+		}()
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		closeBody()
+		close(copied)
+		finish()
+		return nil, err
+	}
+	// Stream the body while the response is read, an application may
+	// answer before it consumed the whole body.
+	go func() {
+		defer close(copied)
+		defer closeBody()
+		if body != nil {
+			io.Copy(conn, body)
+		}
+	}()
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		finish()
+		return nil, fmt.Errorf("uwsgi: reading response: %v", err)
+	}
+	res.Body = &responseBody{ReadCloser: res.Body, finish: finish}
+	return res, nil
+}
+
+// encode builds the uwsgi packet header and variables block.
+func encode(env map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := make([]byte, 0, 1024)
+	for _, name := range names {
+		value := env[name]
+		if len(name) > maxVarsSize || len(value) > maxVarsSize {
+			return nil, ErrVarsTooLarge
+		}
+		vars = binary.LittleEndian.AppendUint16(vars, uint16(len(name)))
+		vars = append(vars, name...)
+		vars = binary.LittleEndian.AppendUint16(vars, uint16(len(value)))
+		vars = append(vars, value...)
+	}
+	if len(vars) > maxVarsSize {
+		return nil, ErrVarsTooLarge
+	}
+	packet := make([]byte, 4, 4+len(vars))
+	packet[0] = modifierWSGI
+	binary.LittleEndian.PutUint16(packet[1:3], uint16(len(vars)))
+	packet[3] = 0
+	return append(packet, vars...), nil
+}
+
+// responseBody closes the connection once the response has been read.
+type responseBody struct {
+	io.ReadCloser
+	finish func()
+	closed bool
+}
+
+func (b *responseBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.closed {
+		b.closed = true
+		b.finish()
+	}
+	return err
+}